@@ -0,0 +1,83 @@
+package engine
+
+import "fmt"
+
+// WriteBatch collects puts and deletes that are committed atomically: after
+// a crash either all of them are in the store or none are. A WriteBatch is
+// not safe for concurrent use.
+type WriteBatch struct {
+	be      *BitcaskEngine
+	records []*encodedRecord
+}
+
+// NewWriteBatch returns an empty batch committing to be.
+func (be *BitcaskEngine) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{be: be}
+}
+
+// Put adds a put of key to the batch. Later operations on the same key in
+// the batch win over earlier ones.
+func (b *WriteBatch) Put(key, value string) error {
+	record, err := encodeRecord(key, value, false)
+	if err != nil {
+		return fmt.Errorf("failed to create file entry: %w", err)
+	}
+	b.records = append(b.records, record)
+	return nil
+}
+
+// PutBytes is Put for binary keys and values. The batch keeps no reference
+// to value once PutBytes returns.
+func (b *WriteBatch) PutBytes(key, value []byte) error {
+	record, err := encodeRecord(key, value, false)
+	if err != nil {
+		return fmt.Errorf("failed to create file entry: %w", err)
+	}
+	b.records = append(b.records, record)
+	return nil
+}
+
+// Delete adds a delete of key to the batch. Unlike BitcaskEngine.Delete it
+// does not fail if the key does not exist.
+func (b *WriteBatch) Delete(key string) error {
+	record, err := encodeRecord(key, "", true)
+	if err != nil {
+		return fmt.Errorf("failed to create tombstone entry: %w", err)
+	}
+	b.records = append(b.records, record)
+	return nil
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.records)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	clear(b.records)
+	b.records = b.records[:0]
+}
+
+// Commit writes every operation of the batch with a single write and, if the
+// sync policy asks for it, a single fsync. Committing an empty batch does
+// nothing.
+func (b *WriteBatch) Commit() error {
+	be := b.be
+	if err := be.checkWritable(); err != nil {
+		return err
+	}
+	if len(b.records) == 0 {
+		return nil
+	}
+
+	err := be.commit(&writeRequest{records: b.records, batch: true})
+	if err == ErrClosed {
+		return err
+	}
+	if err != nil {
+		be.logger.Error("Unable to write batch", "records", len(b.records), "error", err)
+		return fmt.Errorf("unable to write batch: %w", err)
+	}
+	return nil
+}
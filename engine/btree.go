@@ -0,0 +1,354 @@
+package engine
+
+import "sort"
+
+// DefaultBTreeDegree is the minimum number of children of every inner node
+// but the root in a BTreeIndex created by NewBTreeIndex.
+const DefaultBTreeDegree = 32
+
+// BTreeIndex is an in-memory B-tree implementing Index. Lookups and updates
+// take O(log n). Clone is O(1): both copies share their nodes and copy them
+// lazily on the first write, so a snapshot of the keydir costs next to nothing.
+type BTreeIndex struct {
+	degree int
+	length int
+	root   *btreeNode
+	cow    *copyOnWriteContext
+}
+
+// copyOnWriteContext marks the nodes a tree owns and may modify in place.
+// Nodes owned by another context are shared with a clone and copied first.
+type copyOnWriteContext struct {
+	_ byte // Pointers to distinct zero-sized values may compare equal.
+}
+
+type btreeItem struct {
+	key   string
+	entry KeyDir
+}
+
+type btreeNode struct {
+	items    []btreeItem
+	children []*btreeNode
+	cow      *copyOnWriteContext
+}
+
+var _ Index = (*BTreeIndex)(nil)
+
+// NewBTreeIndex returns an empty BTreeIndex of DefaultBTreeDegree.
+func NewBTreeIndex() *BTreeIndex {
+	return NewBTreeIndexDegree(DefaultBTreeDegree)
+}
+
+// NewBTreeIndexDegree returns an empty BTreeIndex whose nodes hold between
+// degree-1 and 2*degree-1 keys. It panics if degree is less than 2.
+func NewBTreeIndexDegree(degree int) *BTreeIndex {
+	if degree < 2 {
+		panic("btree degree must be at least 2")
+	}
+	return &BTreeIndex{degree: degree, cow: &copyOnWriteContext{}}
+}
+
+func (t *BTreeIndex) maxItems() int { return 2*t.degree - 1 }
+func (t *BTreeIndex) minItems() int { return t.degree - 1 }
+
+func (t *BTreeIndex) Get(key string) (KeyDir, bool) {
+	n := t.root
+	for n != nil {
+		i, found := n.find(key)
+		if found {
+			return n.items[i].entry, true
+		}
+		if len(n.children) == 0 {
+			break
+		}
+		n = n.children[i]
+	}
+	return KeyDir{}, false
+}
+
+func (t *BTreeIndex) Set(key string, entry KeyDir) {
+	item := btreeItem{key: key, entry: entry}
+	if t.root == nil {
+		t.root = t.newNode()
+		t.root.items = append(t.root.items, item)
+		t.length++
+		return
+	}
+
+	t.root = t.root.mutableFor(t.cow)
+	if len(t.root.items) >= t.maxItems() {
+		middle, second := t.root.split(t.maxItems() / 2)
+		oldRoot := t.root
+		t.root = t.newNode()
+		t.root.items = append(t.root.items, middle)
+		t.root.children = append(t.root.children, oldRoot, second)
+	}
+	if !t.root.insert(item, t.maxItems()) {
+		t.length++
+	}
+}
+
+func (t *BTreeIndex) Delete(key string) {
+	if t.root == nil {
+		return
+	}
+	t.root = t.root.mutableFor(t.cow)
+	if t.root.remove(key, t.minItems()) {
+		t.length--
+	}
+	if len(t.root.items) == 0 {
+		if len(t.root.children) > 0 {
+			t.root = t.root.children[0]
+		} else {
+			t.root = nil
+		}
+	}
+}
+
+func (t *BTreeIndex) Len() int {
+	return t.length
+}
+
+func (t *BTreeIndex) Range(start, end string, reverse bool, fn func(key string, entry KeyDir) bool) {
+	if t.root == nil {
+		return
+	}
+	if reverse {
+		t.root.descend(start, end, fn)
+	} else {
+		t.root.ascend(start, end, fn)
+	}
+}
+
+// Clone hands the current nodes over to neither tree, so whichever writes
+// first copies the nodes along its path.
+func (t *BTreeIndex) Clone() Index {
+	clone := *t
+	t.cow = &copyOnWriteContext{}
+	clone.cow = &copyOnWriteContext{}
+	return &clone
+}
+
+func (t *BTreeIndex) newNode() *btreeNode {
+	return &btreeNode{cow: t.cow}
+}
+
+// find returns the index of the first item not less than key and whether it
+// equals key.
+func (n *btreeNode) find(key string) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool { return n.items[i].key >= key })
+	return i, i < len(n.items) && n.items[i].key == key
+}
+
+// mutableFor returns n itself if cow owns it and a copy owned by cow otherwise.
+func (n *btreeNode) mutableFor(cow *copyOnWriteContext) *btreeNode {
+	if n.cow == cow {
+		return n
+	}
+	out := &btreeNode{cow: cow}
+	out.items = make([]btreeItem, len(n.items), cap(n.items))
+	copy(out.items, n.items)
+	if len(n.children) > 0 {
+		out.children = make([]*btreeNode, len(n.children), cap(n.children))
+		copy(out.children, n.children)
+	}
+	return out
+}
+
+func (n *btreeNode) mutableChild(i int) *btreeNode {
+	child := n.children[i].mutableFor(n.cow)
+	n.children[i] = child
+	return child
+}
+
+// split moves everything after item i into a new node and returns item i
+// along with that node.
+func (n *btreeNode) split(i int) (btreeItem, *btreeNode) {
+	item := n.items[i]
+	next := &btreeNode{cow: n.cow}
+	next.items = append(next.items, n.items[i+1:]...)
+	clear(n.items[i:])
+	n.items = n.items[:i]
+	if len(n.children) > 0 {
+		next.children = append(next.children, n.children[i+1:]...)
+		clear(n.children[i+1:])
+		n.children = n.children[:i+1]
+	}
+	return item, next
+}
+
+// maybeSplitChild splits child i if it is full, so an insert can descend into it.
+func (n *btreeNode) maybeSplitChild(i, maxItems int) bool {
+	if len(n.children[i].items) < maxItems {
+		return false
+	}
+	first := n.mutableChild(i)
+	item, second := first.split(maxItems / 2)
+	n.items = insertAt(n.items, i, item)
+	n.children = insertAt(n.children, i+1, second)
+	return true
+}
+
+// insert adds item below n, which must not be full, and reports whether it
+// replaced an existing item.
+func (n *btreeNode) insert(item btreeItem, maxItems int) bool {
+	i, found := n.find(item.key)
+	if found {
+		n.items[i] = item
+		return true
+	}
+	if len(n.children) == 0 {
+		n.items = insertAt(n.items, i, item)
+		return false
+	}
+	if n.maybeSplitChild(i, maxItems) {
+		switch middle := n.items[i].key; {
+		case item.key == middle:
+			n.items[i] = item
+			return true
+		case item.key > middle:
+			i++
+		}
+	}
+	return n.mutableChild(i).insert(item, maxItems)
+}
+
+// remove deletes key from below n and reports whether it was there. Every
+// child is grown past minItems before descending into it, so removing from
+// it never leaves it too small.
+func (n *btreeNode) remove(key string, minItems int) bool {
+	i, found := n.find(key)
+	if len(n.children) == 0 {
+		if found {
+			n.items = removeAt(n.items, i)
+		}
+		return found
+	}
+	if len(n.children[i].items) <= minItems {
+		n.growChild(i, minItems)
+		return n.remove(key, minItems)
+	}
+	child := n.mutableChild(i)
+	if found {
+		// Replace the item with its predecessor, the largest item of child i.
+		n.items[i] = child.removeMax(minItems)
+		return true
+	}
+	return child.remove(key, minItems)
+}
+
+// removeMax deletes and returns the largest item below n.
+func (n *btreeNode) removeMax(minItems int) btreeItem {
+	if len(n.children) == 0 {
+		item := n.items[len(n.items)-1]
+		n.items = removeAt(n.items, len(n.items)-1)
+		return item
+	}
+	i := len(n.children) - 1
+	if len(n.children[i].items) <= minItems {
+		n.growChild(i, minItems)
+		i = len(n.children) - 1
+	}
+	return n.mutableChild(i).removeMax(minItems)
+}
+
+// growChild gives child i an extra item, by stealing one from a sibling
+// through n or by merging the child with a sibling.
+func (n *btreeNode) growChild(i, minItems int) {
+	switch {
+	case i > 0 && len(n.children[i-1].items) > minItems:
+		child := n.mutableChild(i)
+		left := n.mutableChild(i - 1)
+		child.items = insertAt(child.items, 0, n.items[i-1])
+		n.items[i-1] = left.items[len(left.items)-1]
+		left.items = removeAt(left.items, len(left.items)-1)
+		if len(left.children) > 0 {
+			child.children = insertAt(child.children, 0, left.children[len(left.children)-1])
+			left.children = removeAt(left.children, len(left.children)-1)
+		}
+	case i < len(n.items) && len(n.children[i+1].items) > minItems:
+		child := n.mutableChild(i)
+		right := n.mutableChild(i + 1)
+		child.items = append(child.items, n.items[i])
+		n.items[i] = right.items[0]
+		right.items = removeAt(right.items, 0)
+		if len(right.children) > 0 {
+			child.children = append(child.children, right.children[0])
+			right.children = removeAt(right.children, 0)
+		}
+	default:
+		if i >= len(n.items) {
+			i--
+		}
+		child := n.mutableChild(i)
+		right := n.children[i+1]
+		child.items = append(child.items, n.items[i])
+		child.items = append(child.items, right.items...)
+		child.children = append(child.children, right.children...)
+		n.items = removeAt(n.items, i)
+		n.children = removeAt(n.children, i+1)
+	}
+}
+
+// ascend visits the items of [start, end) below n in ascending order and
+// reports whether fn asked to carry on.
+func (n *btreeNode) ascend(start, end string, fn func(string, KeyDir) bool) bool {
+	i, _ := n.find(start)
+	for ; i <= len(n.items); i++ {
+		if len(n.children) > 0 && !n.children[i].ascend(start, end, fn) {
+			return false
+		}
+		if i == len(n.items) {
+			break
+		}
+		item := n.items[i]
+		if end != "" && item.key >= end {
+			return false
+		}
+		if !fn(item.key, item.entry) {
+			return false
+		}
+	}
+	return true
+}
+
+// descend visits the items of [start, end) below n in descending order and
+// reports whether fn asked to carry on.
+func (n *btreeNode) descend(start, end string, fn func(string, KeyDir) bool) bool {
+	i := len(n.items)
+	if end != "" {
+		i, _ = n.find(end)
+	}
+	for ; i >= 0; i-- {
+		if len(n.children) > 0 && !n.children[i].descend(start, end, fn) {
+			return false
+		}
+		if i == 0 {
+			break
+		}
+		item := n.items[i-1]
+		if item.key < start {
+			return false
+		}
+		if !fn(item.key, item.entry) {
+			return false
+		}
+	}
+	return true
+}
+
+func insertAt[T any](s []T, i int, v T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func removeAt[T any](s []T, i int) []T {
+	var zero T
+	copy(s[i:], s[i+1:])
+	s[len(s)-1] = zero
+	return s[:len(s)-1]
+}
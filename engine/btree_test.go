@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// checkIndex compares every way of reading idx against the sorted keys of want.
+func checkIndex(t *testing.T, idx Index, want map[string]KeyDir) {
+	t.Helper()
+	if idx.Len() != len(want) {
+		t.Fatalf("Expected %d keys, got %d", len(want), idx.Len())
+	}
+	keys := make([]string, 0, len(want))
+	for key, entry := range want {
+		keys = append(keys, key)
+		if got, ok := idx.Get(key); !ok || got != entry {
+			t.Fatalf("Expected entry %v for key '%s', got %v", entry, key, got)
+		}
+	}
+	slices.Sort(keys)
+
+	var ascending, descending []string
+	idx.Range("", "", false, func(key string, _ KeyDir) bool {
+		ascending = append(ascending, key)
+		return true
+	})
+	idx.Range("", "", true, func(key string, _ KeyDir) bool {
+		descending = append(descending, key)
+		return true
+	})
+	slices.Reverse(descending)
+	if !slices.Equal(ascending, keys) || !slices.Equal(descending, keys) {
+		t.Fatalf("Expected keys %v in order, got %v ascending and %v descending", keys, ascending, descending)
+	}
+}
+
+func TestBTreeIndex_RandomOperations(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, degree := range []int{2, 3, DefaultBTreeDegree} {
+		t.Run(fmt.Sprintf("degree=%d", degree), func(t *testing.T) {
+			idx := NewBTreeIndexDegree(degree)
+			want := make(map[string]KeyDir)
+			for i := range 20000 {
+				key := fmt.Sprintf("%04d", rng.Intn(2000))
+				if rng.Intn(3) == 0 {
+					idx.Delete(key)
+					delete(want, key)
+				} else {
+					entry := KeyDir{Tstamp: int64(i)}
+					idx.Set(key, entry)
+					want[key] = entry
+				}
+				if i%1000 == 0 {
+					checkIndex(t, idx, want)
+				}
+			}
+			checkIndex(t, idx, want)
+
+			for key := range want {
+				idx.Delete(key)
+			}
+			checkIndex(t, idx, map[string]KeyDir{})
+		})
+	}
+}
+
+func TestBTreeIndex_Clone(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	idx := NewBTreeIndexDegree(3)
+	want := make(map[string]KeyDir)
+	for i := range 1000 {
+		key := fmt.Sprintf("%04d", i)
+		entry := KeyDir{Tstamp: int64(i)}
+		idx.Set(key, entry)
+		want[key] = entry
+	}
+
+	clone := idx.Clone()
+	cloneWant := make(map[string]KeyDir, len(want))
+	for key, entry := range want {
+		cloneWant[key] = entry
+	}
+
+	// Write to both copies and make sure neither sees the other's changes.
+	for i := range 5000 {
+		key := fmt.Sprintf("%04d", rng.Intn(1500))
+		target, targetWant := Index(idx), want
+		if i%2 == 1 {
+			target, targetWant = clone, cloneWant
+		}
+		if rng.Intn(2) == 0 {
+			target.Delete(key)
+			delete(targetWant, key)
+		} else {
+			entry := KeyDir{Tstamp: int64(-i)}
+			target.Set(key, entry)
+			targetWant[key] = entry
+		}
+	}
+	checkIndex(t, idx, want)
+	checkIndex(t, clone, cloneWant)
+}
+
+func TestBTreeIndex_Range(t *testing.T) {
+	idx := NewBTreeIndexDegree(2)
+	for _, key := range []string{"a", "b", "ba", "bb", "bz", "b\xff", "b\xff\xff", "c", "d"} {
+		idx.Set(key, KeyDir{})
+	}
+
+	collect := func(start, end string, reverse bool) []string {
+		var keys []string
+		idx.Range(start, end, reverse, func(key string, _ KeyDir) bool {
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	}
+
+	tests := []struct {
+		start, end string
+		want       []string
+	}{
+		{"", "", []string{"a", "b", "ba", "bb", "bz", "b\xff", "b\xff\xff", "c", "d"}},
+		{"b", "c", []string{"b", "ba", "bb", "bz", "b\xff", "b\xff\xff"}},
+		{"ba", "bz", []string{"ba", "bb"}},
+		{"bb", "", []string{"bb", "bz", "b\xff", "b\xff\xff", "c", "d"}},
+		{"b", prefixEnd("b"), []string{"b", "ba", "bb", "bz", "b\xff", "b\xff\xff"}},
+		{"b\xff", prefixEnd("b\xff"), []string{"b\xff", "b\xff\xff"}},
+		{"e", "", nil},
+		{"c", "c", nil},
+	}
+	for _, tt := range tests {
+		if got := collect(tt.start, tt.end, false); !slices.Equal(got, tt.want) {
+			t.Errorf("Range(%q, %q) = %q, expected %q", tt.start, tt.end, got, tt.want)
+		}
+		reversed := slices.Clone(tt.want)
+		slices.Reverse(reversed)
+		if got := collect(tt.start, tt.end, true); !slices.Equal(got, reversed) {
+			t.Errorf("reverse Range(%q, %q) = %q, expected %q", tt.start, tt.end, got, reversed)
+		}
+	}
+
+	var first []string
+	idx.Range("", "", false, func(key string, _ KeyDir) bool {
+		first = append(first, key)
+		return len(first) < 3
+	})
+	if !slices.Equal(first, []string{"a", "b", "ba"}) {
+		t.Errorf("Expected Range to stop when fn returns false, got %q", first)
+	}
+	if prefixEnd("\xff\xff") != "" {
+		t.Errorf("Expected no end for a prefix of 0xff bytes, got %q", prefixEnd("\xff\xff"))
+	}
+}
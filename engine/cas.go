@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errConditionFailed rejects a conditional write whose condition does not
+// hold. It never leaves the engine: the caller gets false instead.
+var errConditionFailed = errors.New("condition not met")
+
+// CompareAndSwap sets key to new if its current value is old and reports
+// whether it did. A key that does not exist never matches.
+func (be *BitcaskEngine) CompareAndSwap(key, old, new string) (bool, error) {
+	if err := be.checkWritable(); err != nil {
+		return false, err
+	}
+
+	record, err := encodeRecord(key, new, false)
+	if err != nil {
+		be.logger.Debug("Unable to encode record", be.keyAttr(key), "error", err)
+		return false, fmt.Errorf("failed to create file entry: %w", err)
+	}
+	return be.putIf(record, func(value []byte, ok bool) bool {
+		return ok && string(value) == old
+	})
+}
+
+// PutIfAbsent sets key to value unless key already exists and reports whether
+// it did.
+func (be *BitcaskEngine) PutIfAbsent(key, value string) (bool, error) {
+	if err := be.checkWritable(); err != nil {
+		return false, err
+	}
+
+	record, err := encodeRecord(key, value, false)
+	if err != nil {
+		be.logger.Debug("Unable to encode record", be.keyAttr(key), "error", err)
+		return false, fmt.Errorf("failed to create file entry: %w", err)
+	}
+	return be.putIf(record, func(_ []byte, ok bool) bool {
+		return !ok
+	})
+}
+
+// DeleteIfEquals deletes key if its current value is value and reports
+// whether it did.
+func (be *BitcaskEngine) DeleteIfEquals(key, value string) (bool, error) {
+	if err := be.checkWritable(); err != nil {
+		return false, err
+	}
+
+	tombstoneEntry, err := encodeRecord(key, "", true)
+	if err != nil {
+		be.logger.Debug("Unable to encode tombstone", be.keyAttr(key), "error", err)
+		return false, fmt.Errorf("failed to create tombstone entry: %w", err)
+	}
+	return be.putIf(tombstoneEntry, func(current []byte, ok bool) bool {
+		return ok && string(current) == value
+	})
+}
+
+// putIf writes record if cond holds for the current value of its key. The
+// value is read and the record written under the same hold of be.mu, so no
+// other write can slip in between.
+func (be *BitcaskEngine) putIf(record *encodedRecord, cond func(value []byte, ok bool) bool) (bool, error) {
+	err := be.commit(&writeRequest{
+		records: []*encodedRecord{record},
+		check: func() error {
+			value, ok, err := be.currentValue(record.key)
+			if err != nil {
+				return err
+			}
+			if !cond(value, ok) {
+				return errConditionFailed
+			}
+			return nil
+		},
+	})
+	if err == errConditionFailed {
+		be.logger.Debug("Conditional write skipped", be.keyAttr(record.key))
+		return false, nil
+	}
+	if err == ErrClosed {
+		return false, err
+	}
+	if err != nil {
+		be.logger.Error("Unable to write record", be.keyAttr(record.key), "error", err)
+		return false, fmt.Errorf("unable to write conditional record: %w", err)
+	}
+	return true, nil
+}
+
+// currentValue reads the live value of key and reports whether there is one.
+// The caller must hold be.mu.
+func (be *BitcaskEngine) currentValue(key string) ([]byte, bool, error) {
+	record, ok := be.keydir.Get(key)
+	if !ok || record.expiredAt(time.Now().UnixNano()) {
+		return nil, false, nil
+	}
+	value, isTombstone, err := be.fetchFromDisk(record)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to fetch record from disk error: %w", err)
+	}
+	return value, !isTombstone, nil
+}
@@ -0,0 +1,286 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A clean Close saves the whole keydir in a checkpoint file, so the next Open
+// can load it instead of reading a hint file or scanning every data file. The
+// checkpoint starts with
+//
+//	magic (4) | version (4) | sequence (8) | last file ID (8) | files (4) | entries (8)
+//
+// followed by the ID (8) and size (8) of every data file it covers, oldest
+// first, and by one entry per key, in key order:
+//
+//	ksz (4) | file (4) | record size (4) | record pos (8) | tstamp (8) | expiry (8) | key
+//
+// where file indexes the list of covered files. A CRC of everything before it
+// ends the file.
+//
+// Data files are never modified once they are covered, so the checkpoint
+// stays valid as long as the files up to its last file ID are exactly the
+// ones it lists, at their recorded sizes. Files written after it are replayed
+// on top of it, which also makes it survive a crash of a later session.
+// Anything else, such as a merge or a repair, makes Open ignore it.
+const (
+	checkpointFileName = "KEYDIR"
+	checkpointTempName = "KEYDIR.tmp"
+	checkpointMagic    = "BCSC"
+
+	checkpointVersion uint32 = 1
+
+	checkpointHeaderSize   = 36
+	checkpointFileSize     = 16
+	checkpointEntrySize    = 36
+	checkpointChecksumSize = 4
+)
+
+var errStaleCheckpoint = errors.New("checkpoint does not match the data files")
+
+// writeCheckpoint atomically saves the keydir as the checkpoint of the store.
+// The caller must hold be.mu exclusively and have closed the active file, so
+// every data file is immutable.
+func (be *BitcaskEngine) writeCheckpoint() error {
+	dataFiles, err := be.listDataFiles()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, checkpointHeaderSize)
+	fileList := make([]byte, 0, len(dataFiles)*checkpointFileSize)
+	fileIndex := make(map[uint32]uint32, len(dataFiles))
+	var lastFileID int64
+	for i, filePath := range dataFiles {
+		fileID, err := parseFileID(filePath)
+		if err != nil {
+			return fmt.Errorf("cannot checkpoint non-numeric data file '%s': %w", filePath, err)
+		}
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			return fmt.Errorf("unable to stat file '%s': %w", filePath, err)
+		}
+		fileList = binary.BigEndian.AppendUint64(fileList, uint64(fileID))
+		fileList = binary.BigEndian.AppendUint64(fileList, uint64(fileInfo.Size()))
+		if id, ok := be.files.lookup(filePath); ok {
+			fileIndex[id] = uint32(i)
+		}
+		lastFileID = max(lastFileID, fileID)
+	}
+	copy(header, checkpointMagic)
+	binary.BigEndian.PutUint32(header[4:8], checkpointVersion)
+	binary.BigEndian.PutUint64(header[8:16], uint64(be.sequence))
+	binary.BigEndian.PutUint64(header[16:24], uint64(lastFileID))
+	binary.BigEndian.PutUint32(header[24:28], uint32(len(dataFiles)))
+	binary.BigEndian.PutUint64(header[28:36], uint64(be.keydir.Len()))
+
+	tempPath := filepath.Join(be.ActiveDir, checkpointTempName)
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create checkpoint '%s': %w", tempPath, err)
+	}
+	crc := crc32.NewIEEE()
+	writer := bufio.NewWriter(io.MultiWriter(file, crc))
+	writer.Write(header)
+	writer.Write(fileList)
+
+	entry := make([]byte, checkpointEntrySize)
+	be.keydir.Range("", "", false, func(key string, record KeyDir) bool {
+		index, ok := fileIndex[record.FileID]
+		if !ok {
+			err = fmt.Errorf("keydir refers to data file '%s' which is not in the store", be.files.path(record.FileID))
+			return false
+		}
+		binary.BigEndian.PutUint32(entry[0:4], uint32(len(key)))
+		binary.BigEndian.PutUint32(entry[4:8], index)
+		binary.BigEndian.PutUint32(entry[8:12], record.ValueSz)
+		binary.BigEndian.PutUint64(entry[12:20], uint64(record.ValuePos))
+		binary.BigEndian.PutUint64(entry[20:28], uint64(record.Tstamp))
+		binary.BigEndian.PutUint64(entry[28:36], uint64(record.Expiry))
+		writer.Write(entry)
+		writer.WriteString(key)
+		return true
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		_, err = file.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, filepath.Join(be.ActiveDir, checkpointFileName))
+	}
+	if err == nil {
+		err = syncDir(be.ActiveDir)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("unable to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// loadCheckpoint fills the keydir from the checkpoint of the store, given its
+// data files as listed by listDataFiles. It returns the ID of the last data
+// file covered by the checkpoint, so that only newer files need replaying. The
+// keydir must be empty, and is left alone if the checkpoint is missing, stale
+// or corrupted.
+func (be *BitcaskEngine) loadCheckpoint(dataFiles []string) (int64, error) {
+	file, err := os.Open(filepath.Join(be.ActiveDir, checkpointFileName))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("unable to stat checkpoint: %w", err)
+	}
+	if fileInfo.Size() < checkpointHeaderSize+checkpointChecksumSize {
+		return 0, fmt.Errorf("%w: truncated checkpoint", ErrCorrupted)
+	}
+	crc := crc32.NewIEEE()
+	reader := bufio.NewReader(io.TeeReader(io.LimitReader(file, fileInfo.Size()-checkpointChecksumSize), crc))
+
+	header := make([]byte, checkpointHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, fmt.Errorf("unable to read checkpoint header: %w", err)
+	}
+	if string(header[:len(checkpointMagic)]) != checkpointMagic {
+		return 0, fmt.Errorf("%w: missing checkpoint header", ErrCorrupted)
+	}
+	if version := binary.BigEndian.Uint32(header[4:8]); version != checkpointVersion {
+		return 0, fmt.Errorf("unsupported checkpoint version %d", version)
+	}
+	sequence := int64(binary.BigEndian.Uint64(header[8:16]))
+	lastFileID := int64(binary.BigEndian.Uint64(header[16:24]))
+	numFiles := binary.BigEndian.Uint32(header[24:28])
+	numEntries := binary.BigEndian.Uint64(header[28:36])
+	if int64(numFiles)*checkpointFileSize > fileInfo.Size() {
+		return 0, fmt.Errorf("%w: checkpoint lists %d data files", ErrCorrupted, numFiles)
+	}
+
+	fileList := make([]byte, int(numFiles)*checkpointFileSize)
+	if _, err := io.ReadFull(reader, fileList); err != nil {
+		return 0, fmt.Errorf("%w: truncated checkpoint file list", ErrCorrupted)
+	}
+	coveredSizes := make(map[int64]int64, numFiles)
+	coveredIDs := make([]int64, numFiles)
+	for i := range coveredIDs {
+		entry := fileList[i*checkpointFileSize:]
+		coveredIDs[i] = int64(binary.BigEndian.Uint64(entry[0:8]))
+		coveredSizes[coveredIDs[i]] = int64(binary.BigEndian.Uint64(entry[8:16]))
+	}
+
+	// The covered files must be exactly the ones on disk up to lastFileID.
+	paths := make(map[int64]string, numFiles)
+	for _, filePath := range dataFiles {
+		fileID, err := parseFileID(filePath)
+		if err != nil {
+			return 0, fmt.Errorf("%w: non-numeric data file '%s'", errStaleCheckpoint, filePath)
+		}
+		if fileID > lastFileID {
+			continue
+		}
+		size, ok := coveredSizes[fileID]
+		if !ok {
+			return 0, fmt.Errorf("%w: data file '%s' is not covered", errStaleCheckpoint, filePath)
+		}
+		dataInfo, err := os.Stat(filePath)
+		if err != nil {
+			return 0, fmt.Errorf("unable to stat file '%s': %w", filePath, err)
+		}
+		if dataInfo.Size() != size {
+			return 0, fmt.Errorf("%w: data file '%s' has %d bytes, checkpoint covers %d", errStaleCheckpoint, filePath, dataInfo.Size(), size)
+		}
+		paths[fileID] = filePath
+	}
+	if len(paths) != len(coveredSizes) {
+		return 0, fmt.Errorf("%w: %d covered data files are missing", errStaleCheckpoint, len(coveredSizes)-len(paths))
+	}
+	fileIDs := make([]uint32, numFiles)
+	for i, coveredID := range coveredIDs {
+		fileIDs[i] = be.files.add(paths[coveredID])
+	}
+
+	// Entries go into a clone of the keydir, which is still empty, that only
+	// replaces it once the checksum has been verified.
+	keydir := be.keydir.Clone()
+	liveBytes := make([]int64, numFiles)
+	hasExpiring := false
+	now := time.Now().UnixNano()
+	entry := make([]byte, checkpointEntrySize)
+	var key []byte
+	var prevKey string
+	for i := uint64(0); i < numEntries; i++ {
+		if _, err := io.ReadFull(reader, entry); err != nil {
+			return 0, fmt.Errorf("%w: truncated checkpoint entry %d", ErrCorrupted, i)
+		}
+		ksz := binary.BigEndian.Uint32(entry[0:4])
+		index := binary.BigEndian.Uint32(entry[4:8])
+		if ksz >= expiryKeySzFlag || int64(ksz) > fileInfo.Size() || index >= numFiles {
+			return 0, fmt.Errorf("%w: malformed checkpoint entry %d", ErrCorrupted, i)
+		}
+		if cap(key) < int(ksz) {
+			key = make([]byte, ksz)
+		}
+		key = key[:ksz]
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return 0, fmt.Errorf("%w: truncated checkpoint entry %d", ErrCorrupted, i)
+		}
+
+		record := KeyDir{
+			FileID:   fileIDs[index],
+			ValueSz:  binary.BigEndian.Uint32(entry[8:12]),
+			ValuePos: int64(binary.BigEndian.Uint64(entry[12:20])),
+			Tstamp:   int64(binary.BigEndian.Uint64(entry[20:28])),
+			Expiry:   int64(binary.BigEndian.Uint64(entry[28:36])),
+		}
+		keyString := string(key)
+		if i > 0 && keyString <= prevKey {
+			return 0, fmt.Errorf("%w: checkpoint entry %d is out of order", ErrCorrupted, i)
+		}
+		prevKey = keyString
+		if record.expiredAt(now) {
+			continue
+		}
+		keydir.Set(keyString, record)
+		liveBytes[index] += int64(record.ValueSz)
+		if record.Expiry != 0 {
+			hasExpiring = true
+		}
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		return 0, fmt.Errorf("%w: trailing data after the last checkpoint entry", ErrCorrupted)
+	}
+
+	checksum := make([]byte, checkpointChecksumSize)
+	if _, err := file.ReadAt(checksum, fileInfo.Size()-checkpointChecksumSize); err != nil {
+		return 0, fmt.Errorf("unable to read checkpoint checksum: %w", err)
+	}
+	if stored := binary.BigEndian.Uint32(checksum); stored != crc.Sum32() {
+		return 0, fmt.Errorf("%w: checkpoint checksum mismatch (stored %08x, computed %08x)", ErrCorrupted, stored, crc.Sum32())
+	}
+
+	be.keydir = keydir
+	for i, fileID := range fileIDs {
+		be.files.addLive(fileID, liveBytes[i])
+	}
+	be.sequence = max(be.sequence, sequence)
+	be.hasExpiring = be.hasExpiring || hasExpiring
+	return lastFileID, nil
+}
@@ -0,0 +1,235 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxGroupSize caps how many queued requests a single leader commits, so the
+// writers at the back of a long queue are not held up indefinitely.
+const maxGroupSize = 1024
+
+// writeRequest is a set of records appended and acknowledged together.
+type writeRequest struct {
+	records []*encodedRecord
+
+	// batch frames the records as one batch record, so recovery applies
+	// them all or none of them.
+	batch bool
+
+	// check, if set, runs under be.mu right before the records are written.
+	// An error rejects the request without writing anything.
+	check func() error
+
+	// entries are the keydir entries of the records once written, and prior
+	// the ones their keys had before, so the update can be undone and
+	// redone around the fsync.
+	entries []KeyDir
+	prior   []priorEntry
+
+	err  error
+	done bool
+}
+
+// priorEntry is the keydir entry a key had before a request changed it.
+type priorEntry struct {
+	entry KeyDir
+	ok    bool
+}
+
+// commit appends the records of req through the group commit pipeline.
+// Concurrent writers queue up behind each other; whoever is at the front
+// becomes the leader, writes the records of every queued request, fsyncs once
+// according to the sync policy and then acknowledges the whole group. If the
+// group is fsynced, its keydir updates are only made visible once the fsync
+// has succeeded, so no reader ever sees a write that may yet be lost.
+func (be *BitcaskEngine) commit(req *writeRequest) error {
+	be.writeMu.Lock()
+	be.writers = append(be.writers, req)
+	for !req.done && be.writers[0] != req {
+		be.writeCond.Wait()
+	}
+	if req.done {
+		be.writeMu.Unlock()
+		return req.err
+	}
+
+	group := be.writers
+	if len(group) > maxGroupSize {
+		group = group[:maxGroupSize]
+	}
+	group = append([]*writeRequest(nil), group...)
+	be.writeMu.Unlock()
+
+	be.writeGroup(group)
+
+	be.writeMu.Lock()
+	for _, r := range group {
+		r.done = true
+	}
+	be.writers = be.writers[len(group):]
+	be.writeCond.Broadcast()
+	be.writeMu.Unlock()
+	return req.err
+}
+
+// writeGroup applies every request in group and then fsyncs once if the sync
+// policy asks for it. The outcome of each request is left in its err field.
+func (be *BitcaskEngine) writeGroup(group []*writeRequest) {
+	be.mu.Lock()
+	syncFrom := ""
+	if be.ActiveFile != nil {
+		syncFrom = be.ActiveFile.Name()
+	}
+	needsSync := false
+	for _, req := range group {
+		req.err = be.applyWrite(req)
+		if req.err != nil || len(req.records) == 0 {
+			continue
+		}
+		switch be.syncPolicy {
+		case SyncAlways:
+			needsSync = true
+		case SyncEveryN:
+			be.unsyncedWrites += len(req.records)
+			if be.unsyncedWrites >= be.syncEveryN {
+				be.unsyncedWrites = 0
+				needsSync = true
+			}
+		}
+	}
+	if needsSync {
+		// Readers keep seeing the keydir as it was before the group until
+		// the fsync is done, and Merge keeps its hands off the files the
+		// hidden records went to.
+		be.hideWrites(group)
+		be.hiddenFrom = syncFrom
+	}
+	be.mu.Unlock()
+
+	if !needsSync {
+		return
+	}
+
+	// A read lock is enough to keep the active file from being closed under
+	// us, and it lets Get carry on during the fsync.
+	be.mu.RLock()
+	var err error
+	if be.ActiveFile != nil {
+		err = be.ActiveFile.Sync()
+	}
+	be.mu.RUnlock()
+
+	be.mu.Lock()
+	be.hiddenFrom = ""
+	if err == nil {
+		be.showWrites(group)
+	}
+	be.mu.Unlock()
+
+	if err != nil {
+		be.logger.Error("Unable to sync active file", "error", err)
+		for _, req := range group {
+			if req.err == nil {
+				req.err = fmt.Errorf("unable to sync active file: %w", err)
+			}
+		}
+	}
+}
+
+// applyWrite runs the check of req, appends its records and updates the
+// keydir. The caller must hold be.mu.
+func (be *BitcaskEngine) applyWrite(req *writeRequest) error {
+	if be.closed {
+		return ErrClosed
+	}
+	if req.check != nil {
+		if err := req.check(); err != nil {
+			return err
+		}
+	}
+	// Sequence numbers are handed out under be.mu in the order records hit
+	// the disk, so they agree with the order writers were acknowledged in.
+	for _, record := range req.records {
+		record.stamp(be.nextSequence())
+	}
+
+	var keydirEntries []KeyDir
+	if req.batch {
+		var err error
+		if keydirEntries, err = be.putBatch(req.records); err != nil {
+			return err
+		}
+	} else {
+		for _, record := range req.records {
+			keydirEntry, err := be.putFileEntry(record)
+			if err != nil {
+				return err
+			}
+			keydirEntries = append(keydirEntries, keydirEntry)
+		}
+	}
+
+	req.entries = keydirEntries
+	req.prior = make([]priorEntry, len(req.records))
+	for i, record := range req.records {
+		req.prior[i].entry, req.prior[i].ok = be.keydir.Get(record.key)
+		be.applyEntry(record, keydirEntries[i])
+	}
+	return nil
+}
+
+// applyEntry points the key of record at entry, or removes the key if record
+// is a tombstone. The caller must hold be.mu exclusively.
+func (be *BitcaskEngine) applyEntry(record *encodedRecord, entry KeyDir) {
+	if record.isTombstone {
+		be.deleteKey(record.key)
+	} else {
+		be.setKey(record.key, entry)
+	}
+}
+
+// hideWrites undoes the keydir updates of the requests of group that
+// succeeded, newest first. The caller must hold be.mu exclusively.
+func (be *BitcaskEngine) hideWrites(group []*writeRequest) {
+	for i := len(group) - 1; i >= 0; i-- {
+		req := group[i]
+		if req.err != nil {
+			continue
+		}
+		for j := len(req.records) - 1; j >= 0; j-- {
+			if prior := req.prior[j]; prior.ok {
+				be.setKey(req.records[j].key, prior.entry)
+			} else {
+				be.deleteKey(req.records[j].key)
+			}
+		}
+	}
+}
+
+// showWrites redoes the keydir updates undone by hideWrites. The caller must
+// hold be.mu exclusively.
+func (be *BitcaskEngine) showWrites(group []*writeRequest) {
+	for _, req := range group {
+		if req.err != nil {
+			continue
+		}
+		for i, record := range req.records {
+			be.applyEntry(record, req.entries[i])
+		}
+	}
+}
+
+// nextSequence returns the sequence number of the next record written. It is
+// the current time in Unix nanoseconds unless that would not exceed the last
+// sequence number written or found on disk, which keeps sequence numbers
+// strictly increasing across restarts and clock steps. The caller must hold
+// be.mu exclusively.
+func (be *BitcaskEngine) nextSequence() int64 {
+	sequence := time.Now().UnixNano()
+	if sequence <= be.sequence {
+		sequence = be.sequence + 1
+	}
+	be.sequence = sequence
+	return sequence
+}
@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+)
+
+// MergeWindow limits automatic merges to the hours from StartHour up to and
+// including EndHour, in local time. A window whose EndHour is before its
+// StartHour wraps around midnight, so {22, 5} allows merging from 22:00 to
+// 05:59.
+type MergeWindow struct {
+	StartHour int
+	EndHour   int
+}
+
+// validate checks that both hours of the window are hours of the day.
+func (w MergeWindow) validate() error {
+	if w.StartHour < 0 || w.StartHour > 23 || w.EndHour < 0 || w.EndHour > 23 {
+		return fmt.Errorf("invalid merge window %d-%d: hours must be from 0 to 23", w.StartHour, w.EndHour)
+	}
+	return nil
+}
+
+// contains reports whether t falls within the window.
+func (w MergeWindow) contains(t time.Time) bool {
+	hour := t.Hour()
+	if w.StartHour <= w.EndHour {
+		return hour >= w.StartHour && hour <= w.EndHour
+	}
+	return hour >= w.StartHour || hour <= w.EndHour
+}
+
+// mergeTrigger holds the thresholds past which an immutable data file is
+// worth merging. A threshold of zero or less is never reached.
+type mergeTrigger struct {
+	fragmentation float64
+	deadBytes     int64
+}
+
+// setKey points key at entry, moving the bytes of its previous record, if
+// any, over to the dead ones of that record's file. The caller must hold
+// be.mu exclusively.
+func (be *BitcaskEngine) setKey(key string, entry KeyDir) {
+	if old, ok := be.keydir.Get(key); ok {
+		be.files.addLive(old.FileID, -int64(old.ValueSz))
+	}
+	be.keydir.Set(key, entry)
+	be.files.addLive(entry.FileID, int64(entry.ValueSz))
+}
+
+// deleteKey removes key from the keydir, so its record becomes dead. The
+// caller must hold be.mu exclusively.
+func (be *BitcaskEngine) deleteKey(key string) {
+	if old, ok := be.keydir.Get(key); ok {
+		be.files.addLive(old.FileID, -int64(old.ValueSz))
+		be.keydir.Delete(key)
+	}
+}
+
+// mergeLoop checks every interval whether any immutable data file has crossed
+// a threshold of trigger and merges if so, as long as the time is within
+// window, if there is one. It runs until Close. Merge always takes every
+// immutable file, since dropping a tombstone is only safe when no older file
+// that might hold the deleted value is left behind.
+func (be *BitcaskEngine) mergeLoop(interval time.Duration, trigger mergeTrigger, window *MergeWindow) {
+	defer be.backgroundDone.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-be.stopBackground:
+			return
+		case now := <-ticker.C:
+			if window != nil && !window.contains(now) {
+				continue
+			}
+			filePath, ok := be.fragmentedFile(trigger)
+			if !ok {
+				continue
+			}
+			be.logger.Info("Starting automatic merge", "file", filePath)
+			if err := be.Merge(); err != nil && err != ErrClosed {
+				be.logger.Error("Automatic merge failed", "error", err)
+			}
+		}
+	}
+}
+
+// fragmentedFile returns the path of an immutable data file that has crossed
+// a threshold of trigger, if there is one.
+func (be *BitcaskEngine) fragmentedFile(trigger mergeTrigger) (string, bool) {
+	be.mu.RLock()
+	defer be.mu.RUnlock()
+
+	if be.closed {
+		return "", false
+	}
+	// Files kept for open snapshots are merged already.
+	obsolete := make(map[string]bool, len(be.obsoleteFiles))
+	for _, filePath := range be.obsoleteFiles {
+		obsolete[filePath] = true
+	}
+	for fileID, filePath := range be.files.paths {
+		if (be.ActiveFile != nil && fileID == be.activeFileID) || obsolete[filePath] {
+			continue
+		}
+		stats := be.files.usage(fileID)
+		if trigger.fragmentation > 0 && stats.fragmentation() >= trigger.fragmentation {
+			return filePath, true
+		}
+		if trigger.deadBytes > 0 && stats.deadBytes() >= trigger.deadBytes {
+			return filePath, true
+		}
+	}
+	return "", false
+}
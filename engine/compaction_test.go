@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMergeWindowContains(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2024, 1, 1, hour, 30, 0, 0, time.Local)
+	}
+	tests := []struct {
+		window MergeWindow
+		hour   int
+		want   bool
+	}{
+		{MergeWindow{StartHour: 1, EndHour: 5}, 0, false},
+		{MergeWindow{StartHour: 1, EndHour: 5}, 1, true},
+		{MergeWindow{StartHour: 1, EndHour: 5}, 5, true},
+		{MergeWindow{StartHour: 1, EndHour: 5}, 6, false},
+		{MergeWindow{StartHour: 22, EndHour: 3}, 23, true},
+		{MergeWindow{StartHour: 22, EndHour: 3}, 2, true},
+		{MergeWindow{StartHour: 22, EndHour: 3}, 12, false},
+		{MergeWindow{StartHour: 0, EndHour: 23}, 12, true},
+	}
+	for _, tt := range tests {
+		if got := tt.window.contains(at(tt.hour)); got != tt.want {
+			t.Errorf("%+v.contains(%d:30) = %v, want %v", tt.window, tt.hour, got, tt.want)
+		}
+	}
+}
+
+func TestOpenRejectsInvalidMergeWindow(t *testing.T) {
+	for _, window := range []MergeWindow{{StartHour: -1, EndHour: 5}, {StartHour: 22, EndHour: 24}} {
+		opts := Options{MergeCheckInterval: time.Minute, MergeWindow: &window, Logger: slog.New(slog.DiscardHandler)}
+		if be, err := Open(t.TempDir(), opts); err == nil {
+			be.Close()
+			t.Errorf("Expected Open to reject merge window %+v", window)
+		}
+	}
+}
+
+// TestDeadBytes checks that the stats kept up to date by writes agree with
+// the ones rebuilt from the checkpoint, from hint files and from the records.
+func TestDeadBytes(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{MaxFileSize: 300, MergeCheckInterval: -1, Logger: slog.New(slog.DiscardHandler)}
+
+	fileStatsOf := func(be *BitcaskEngine) map[string]fileStats {
+		be.mu.RLock()
+		defer be.mu.RUnlock()
+		result := make(map[string]fileStats)
+		for id, filePath := range be.files.paths {
+			result[filepath.Base(filePath)] = be.files.usage(id)
+		}
+		return result
+	}
+
+	be, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open engine: %v", err)
+	}
+	for i := range 60 {
+		key := fmt.Sprintf("key%d", i%7)
+		switch {
+		case i%9 == 4:
+			be.Delete(key)
+		case i%13 == 6:
+			batch := be.NewWriteBatch()
+			batch.Put(key, "batched")
+			batch.Delete(fmt.Sprintf("key%d", (i+1)%7))
+			if err := batch.Commit(); err != nil {
+				t.Fatalf("Batch commit failed: %v", err)
+			}
+		default:
+			if err := be.Put(key, fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if i == 40 {
+			if err := be.Merge(); err != nil {
+				t.Fatalf("Merge failed: %v", err)
+			}
+		}
+	}
+	live := fileStatsOf(be)
+	var dead int64
+	for _, stats := range live {
+		dead += stats.deadBytes()
+	}
+	if dead == 0 {
+		t.Fatalf("Expected overwrites and deletes to leave dead bytes, got %v", live)
+	}
+	be.Close()
+
+	reopened := func(name string) {
+		t.Helper()
+		be, err := Open(dir, opts)
+		if err != nil {
+			t.Fatalf("Failed to open engine: %v", err)
+		}
+		// Opening adds an empty active file, which is dropped again.
+		activeFile := be.ActiveFile.Name()
+		got := fileStatsOf(be)
+		delete(got, filepath.Base(activeFile))
+		be.Close()
+		if !maps.Equal(got, live) {
+			t.Errorf("Stats rebuilt from %s differ:\n got  %v\n want %v", name, got, live)
+		}
+		os.Remove(filepath.Join(dir, "KEYDIR"))
+		os.Remove(hintPath(activeFile))
+		os.Remove(activeFile)
+	}
+	reopened("the checkpoint")
+	reopened("hint files")
+
+	hints, _ := filepath.Glob(filepath.Join(dir, "*.hint"))
+	for _, hint := range hints {
+		os.Remove(hint)
+	}
+	reopened("data files")
+}
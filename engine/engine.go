@@ -1,14 +1,19 @@
 package engine
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
-	"encoding/gob"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -18,375 +23,1130 @@ import (
 
 type Bitcask interface {
 	Get(key string) (string, error)
+	GetBytes(key []byte) ([]byte, error)
 	Put(key string, value string) error
+	PutBytes(key, value []byte) error
+	PutWithTTL(key, value string, ttl time.Duration) error
 	Delete(key string) error
+	Keys() ([]string, error)
+	Len() int
+	Has(key string) bool
+	Fold(fn func(key, value string) error) error
+	Scan(start, end string, reverse bool) (*Iterator, error)
+	PrefixScan(prefix string, reverse bool) (*Iterator, error)
+	NewWriteBatch() *WriteBatch
+	Begin() (*Txn, error)
+	CompareAndSwap(key, old, new string) (bool, error)
+	PutIfAbsent(key, value string) (bool, error)
+	DeleteIfEquals(key, value string) (bool, error)
 	BuildIndex() error
 	Merge() error
 }
 
 type BitcaskEngine struct {
-	Keydir      map[string]*KeyDir
-	ActiveFile  *os.File
-	ActiveDir   string
-	mu          sync.RWMutex
+	// keydir maps every live key to its newest record. It is guarded by mu.
+	keydir     Index
+	ActiveFile *os.File
+	ActiveDir  string
+	mu         sync.RWMutex
+	mergeMu    sync.Mutex
+
+	// writeMu guards the queue of writers waiting for the group commit leader.
+	writeMu   sync.Mutex
+	writeCond *sync.Cond
+	writers   []*writeRequest
+
 	MaxFileSize int64
+
+	// Repair makes BuildIndex truncate a data file at a corrupted record
+	// anywhere in it, instead of failing. Every data file is scanned, hint
+	// files and the checkpoint notwithstanding. Torn writes at the tail of the
+	// newest file are always truncated.
+	Repair bool
+
+	// indexWorkers is the number of data files BuildIndex reads at once.
+	indexWorkers int
+
+	syncPolicy     SyncPolicy
+	syncEveryN     int
+	unsyncedWrites int
+
+	// stopBackground is closed by Close to stop the background sync, expiry
+	// sweeper and merge scheduler, which report to backgroundDone. stopOnce
+	// keeps concurrent calls to Close from closing it twice.
+	stopBackground chan struct{}
+	backgroundDone sync.WaitGroup
+	stopOnce       sync.Once
+
+	// hasExpiring is set once any key with a TTL is indexed, so the sweeper
+	// does not walk the keydir of a store that never uses TTLs.
+	hasExpiring bool
+
+	// hiddenFrom is the active file at the start of a write group whose
+	// keydir updates are hidden until its fsync is done, or empty. It is
+	// guarded by mu.
+	hiddenFrom string
+
+	// sequence is the highest sequence number written or found on disk, and
+	// lastFileID the highest data file ID. Both are guarded by mu.
+	sequence   int64
+	lastFileID int64
+
+	readOnly bool
+	closed   bool
+	logger   *slog.Logger
+	logKeys  bool
+	lockFile *os.File
+
+	// readers holds the read-only handles Get reads records through.
+	readers *readerCache
+
+	// files maps the FileID of keydir entries to data file paths, and
+	// activeFileID is the FileID of ActiveFile. Both are guarded by mu.
+	files        *fileTable
+	activeFileID uint32
+
+	// writeFile appends to ActiveFile. Tests replace it to make writes fail.
+	writeFile func(*os.File, []byte) (int, error)
+
+	// snapshots counts the open keydir snapshots. Files merged away while
+	// any are open are listed in obsoleteFiles and removed once the last
+	// snapshot is released.
+	snapshots     int
+	obsoleteFiles []string
+
+	// activeHints collects the encoded hint entries of ActiveFile, written out
+	// as its hint file once the file becomes immutable.
+	activeHints  []byte
+	collectHints bool
 }
 
+var _ Bitcask = (*BitcaskEngine)(nil)
+
+const lockFileName = "LOCK"
+
+// redactedKey stands in for keys in log output.
+const redactedKey = "[redacted]"
+
+// NewBistcaskEngine opens directory with DefaultOptions.
+//
+// Deprecated: use Open, which also accepts Options.
 func NewBistcaskEngine(directory string) (*BitcaskEngine, error) {
+	return Open(directory, DefaultOptions())
+}
+
+// Open opens the store in directory, creating the directory if needed, and
+// rebuilds the keydir from the data files already there. Unless the store is
+// opened read-only a fresh active file is created for new writes.
+//
+// The directory is locked until Close: exclusively for a writer, shared for a
+// read-only engine. Open fails with ErrDatabaseLocked if that conflicts with
+// another engine.
+func Open(directory string, opts Options) (*BitcaskEngine, error) {
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = DefaultMaxFileSize
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.NewIndex == nil {
+		opts.NewIndex = func() Index { return NewBTreeIndex() }
+	}
+	if opts.SyncEveryN <= 0 {
+		opts.SyncEveryN = 1
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if opts.ExpirySweepInterval == 0 {
+		opts.ExpirySweepInterval = DefaultExpirySweepInterval
+	}
+	if opts.IndexWorkers <= 0 {
+		opts.IndexWorkers = runtime.GOMAXPROCS(0)
+	}
+	if opts.MergeFragmentation == 0 {
+		opts.MergeFragmentation = DefaultMergeFragmentation
+	}
+	if opts.MergeDeadBytes == 0 {
+		opts.MergeDeadBytes = DefaultMergeDeadBytes
+	}
+	if opts.MergeWindow != nil {
+		if err := opts.MergeWindow.validate(); err != nil {
+			opts.Logger.Error("Invalid merge window", "error", err)
+			return nil, err
+		}
+	}
+
 	_, err := os.Stat(directory)
-	if os.IsNotExist(err) {
+	if os.IsNotExist(err) && !opts.ReadOnly {
 		permissions := os.FileMode(0755)
 		err = os.MkdirAll(directory, permissions)
 		if err != nil {
-			// Using log.Fatalf here because failing to create the directory is a critical setup error.
-			log.Fatalf("Error creating directory '%s': %v", directory, err)
-			return nil, err // This line will not be reached due to Fatalln
+			opts.Logger.Error("Unable to create directory", "dir", directory, "error", err)
+			return nil, fmt.Errorf("unable to create directory '%s': %w", directory, err)
 		}
 	} else if err != nil {
-		// Using log.Fatalf here for similar reasons, unable to check directory is critical.
-		log.Fatalf("Error checking directory '%s': '%v'", directory, err)
-		return nil, err // This line will not be reached due to Fatalln
+		opts.Logger.Error("Unable to check directory", "dir", directory, "error", err)
+		return nil, fmt.Errorf("unable to check directory '%s': %w", directory, err)
 	}
 
-	filename := fmt.Sprintf("%d.data", time.Now().Unix())
-	activeFilePath := filepath.Join(directory, filename)
+	lockFile, err := acquireLock(filepath.Join(directory, lockFileName), opts.ReadOnly)
+	if err != nil {
+		opts.Logger.Error("Unable to lock directory", "dir", directory, "error", err)
+		return nil, err
+	}
 
-	// Original fmt.Printf commented out, log.Printf can be used if needed for debug
-	// log.Printf("chosen file name is %s", activeFilePath)
+	be := &BitcaskEngine{
+		keydir:       opts.NewIndex(),
+		ActiveDir:    directory,
+		MaxFileSize:  opts.MaxFileSize,
+		Repair:       opts.Repair,
+		syncPolicy:   opts.SyncPolicy,
+		syncEveryN:   opts.SyncEveryN,
+		indexWorkers: opts.IndexWorkers,
+		readOnly:     opts.ReadOnly,
+		logger:       opts.Logger,
+		logKeys:      opts.LogKeys,
+		lockFile:     lockFile,
+		readers:      newReaderCache(opts.Mmap),
+		files:        newFileTable(),
+		writeFile:    (*os.File).Write,
+	}
+	be.writeCond = sync.NewCond(&be.writeMu)
+	be.stopBackground = make(chan struct{})
 
-	newActiveFile, err := os.OpenFile(activeFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		// Fatal error if we can't create the active file.
-		log.Fatalf("Error creating new file '%s': '%v'", activeFilePath, err)
-		return nil, err // This line will not be reached due to Fatalln
+	if err := be.BuildIndex(); err != nil {
+		be.readers.closeAll()
+		releaseLock(lockFile)
+		return nil, err
 	}
+	if !be.readOnly {
+		activeFilePath := be.nextDataFilePath()
+		newActiveFile, err := openDataFile(activeFilePath)
+		if err != nil {
+			be.readers.closeAll()
+			releaseLock(lockFile)
+			be.logger.Error("Unable to create active file", "file", activeFilePath, "error", err)
+			return nil, fmt.Errorf("unable to create active file '%s': %w", activeFilePath, err)
+		}
+		be.setActiveFile(newActiveFile)
+	}
+
+	// Background goroutines only start once Open can no longer fail, so an
+	// error never leaves one running.
+	if opts.ExpirySweepInterval > 0 {
+		be.backgroundDone.Add(1)
+		go be.sweepLoop(opts.ExpirySweepInterval)
+	}
+	if be.readOnly {
+		return be, nil
+	}
+	if be.syncPolicy == SyncInterval {
+		be.backgroundDone.Add(1)
+		go be.syncLoop(opts.SyncInterval)
+	}
+	if opts.MergeCheckInterval > 0 {
+		be.backgroundDone.Add(1)
+		go be.mergeLoop(opts.MergeCheckInterval, mergeTrigger{
+			fragmentation: opts.MergeFragmentation,
+			deadBytes:     opts.MergeDeadBytes,
+		}, opts.MergeWindow)
+	}
+	return be, nil
+}
+
+// syncLoop fsyncs the active file every interval until Close.
+func (be *BitcaskEngine) syncLoop(interval time.Duration) {
+	defer be.backgroundDone.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	return &BitcaskEngine{
-		Keydir:      make(map[string]*KeyDir),
-		ActiveFile:  newActiveFile,
-		ActiveDir:   directory,
-		MaxFileSize: 1 * 1024 * 1024, // 1MB
-	}, nil
+	for {
+		select {
+		case <-be.stopBackground:
+			return
+		case <-ticker.C:
+			if err := be.Sync(); err != nil {
+				be.logger.Error("Background sync failed", "error", err)
+			}
+		}
+	}
+}
+
+// Sync flushes everything written to the active file to stable storage.
+func (be *BitcaskEngine) Sync() error {
+	be.mu.RLock()
+	defer be.mu.RUnlock()
+
+	if be.closed {
+		return ErrClosed
+	}
+	if be.ActiveFile == nil {
+		return nil
+	}
+	if err := be.ActiveFile.Sync(); err != nil {
+		be.logger.Error("Unable to sync active file", "error", err)
+		return fmt.Errorf("unable to sync active file: %w", err)
+	}
+	return nil
 }
 
+// Close flushes and closes the store and releases the directory lock. Every
+// later call on the engine, including Close, fails with ErrClosed. A merge
+// that is running is waited for.
 func (be *BitcaskEngine) Close() error {
+	// Stop the background goroutines first, they need the lock to finish.
+	be.stopOnce.Do(func() {
+		if be.stopBackground != nil {
+			close(be.stopBackground)
+		}
+		be.backgroundDone.Wait()
+	})
+
+	// A running merge removes its input files once it is done, which must
+	// never happen after the directory lock is released and another engine
+	// may have opened the store. Wait for it to finish first.
+	be.mergeMu.Lock()
+	defer be.mergeMu.Unlock()
+
 	be.mu.Lock()
 	defer be.mu.Unlock()
 
-	if be.ActiveFile == nil {
-		return nil
+	if be.closed {
+		return ErrClosed
 	}
-	err := be.ActiveFile.Close()
-	be.ActiveFile = nil
-	if err != nil {
-		log.Printf("Error closing active file: %v", err)
+	be.closed = true
+
+	var err error
+	if be.ActiveFile != nil {
+		// An active file nothing was written to is removed rather than left
+		// behind, so opening and closing a store does not pile up empty data
+		// files and their hints.
+		activePath := be.ActiveFile.Name()
+		empty := false
+		if fileInfo, statErr := be.ActiveFile.Stat(); statErr == nil {
+			empty = fileInfo.Size() <= fileHeaderSize
+		}
+		if !empty {
+			be.writeActiveHint()
+		}
+		if be.syncPolicy != SyncNever {
+			err = be.ActiveFile.Sync()
+		}
+		if closeErr := be.ActiveFile.Close(); err == nil {
+			err = closeErr
+		}
+		be.ActiveFile = nil
+		if err != nil {
+			be.logger.Error("Unable to close active file", "error", err)
+		} else if empty {
+			be.readers.evict(activePath)
+			if removeErr := os.Remove(activePath); removeErr != nil {
+				be.logger.Warn("Unable to remove empty active file", "file", activePath, "error", removeErr)
+			}
+		}
+	}
+	be.removeObsoleteFiles()
+	// The checkpoint only speeds up the next Open, so failing to write it is
+	// not an error. It must only cover a fully written active file, and
+	// not miss records whose keydir entries are hidden during an fsync.
+	if !be.readOnly && err == nil && be.hiddenFrom == "" {
+		if checkpointErr := be.writeCheckpoint(); checkpointErr != nil {
+			be.logger.Warn("Unable to write keydir checkpoint", "dir", be.ActiveDir, "error", checkpointErr)
+		}
+	}
+	if closeErr := be.readers.closeAll(); closeErr != nil {
+		be.logger.Error("Unable to close data file readers", "error", closeErr)
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if be.lockFile != nil {
+		if unlockErr := releaseLock(be.lockFile); unlockErr != nil {
+			be.logger.Error("Unable to release directory lock", "error", unlockErr)
+			if err == nil {
+				err = unlockErr
+			}
+		}
+		be.lockFile = nil
 	}
 	return err
 }
 
+// Get returns the value stored for key, or ErrKeyNotFound if there is none.
 func (be *BitcaskEngine) Get(key string) (string, error) {
-	be.mu.Lock()
-	defer be.mu.Unlock()
+	value, err := be.get(key)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
 
-	record, ok := be.Keydir[key]
+// GetBytes is Get for binary keys and values. The returned slice belongs to
+// the caller.
+func (be *BitcaskEngine) GetBytes(key []byte) ([]byte, error) {
+	return be.get(string(key))
+}
+
+func (be *BitcaskEngine) get(key string) ([]byte, error) {
+	// Writers only need the exclusive lock to touch the keydir and to close
+	// files, so reads can share the lock and run in parallel.
+	be.mu.RLock()
+	defer be.mu.RUnlock()
+
+	if be.closed {
+		return nil, ErrClosed
+	}
+	record, ok := be.keydir.Get(key)
 	if !ok {
-		log.Printf("Unable to find key '%s' in keydir", key)
-		return "", fmt.Errorf("key not found error")
+		be.logger.Debug("Key not found in keydir", be.keyAttr(key))
+		return nil, ErrKeyNotFound
+	}
+	if record.expiredAt(time.Now().UnixNano()) {
+		be.logger.Debug("Key has expired", be.keyAttr(key))
+		return nil, ErrKeyNotFound
 	}
 
-	entry, err := be.fetchFromDisk(record)
+	value, isTombstone, err := be.fetchFromDisk(record)
 	if err != nil {
-		log.Printf("Unable to fetch record '%v' from disk: '%v'", record, err)
-		return "", fmt.Errorf("unable to fetch record from disk error: %w", err)
+		be.logger.Error("Unable to fetch record from disk", be.keyAttr(key), "file", be.files.path(record.FileID), "offset", record.ValuePos, "error", err)
+		return nil, fmt.Errorf("unable to fetch record from disk error: %w", err)
 	}
-	if entry.IsTombstone {
-		log.Printf("Attempted to retrieve deleted key '%s'", key)
-		return "", fmt.Errorf("key '%s' has been deleted", key)
+	if isTombstone {
+		be.logger.Debug("Attempted to retrieve deleted key", be.keyAttr(key))
+		return nil, fmt.Errorf("%w: key has been deleted", ErrKeyNotFound)
 	}
 
-	return entry.Value, nil
+	return value, nil
 }
 
-func (be *BitcaskEngine) fetchFromDisk(record *KeyDir) (*FileEntry, error) {
-
-	file, err := os.Open(record.FileID)
+// fetchFromDisk reads the record that record points at through the cached
+// reader of its file. The caller must hold be.mu, at least for reading.
+func (be *BitcaskEngine) fetchFromDisk(record KeyDir) ([]byte, bool, error) {
+	filePath := be.files.path(record.FileID)
+	immutable := be.ActiveFile == nil || record.FileID != be.activeFileID
+	reader, err := be.readers.get(filePath, immutable)
 	if err != nil {
-		log.Printf("Unable to open file '%s': '%v'", record.FileID, err)
-		return nil, fmt.Errorf("unable to open file '%s': %w", record.FileID, err)
+		be.logger.Debug("Unable to open data file", "file", filePath, "error", err)
+		return nil, false, err
+	}
+	return be.readValue(reader, record)
+}
+
+// readValue decodes the record that record points at, slicing it out of the
+// mapping of reader if there is one and reading it from disk otherwise. It
+// returns the value, which is never shared with the mapping, and whether the
+// record is a tombstone.
+func (be *BitcaskEngine) readValue(reader *readerFile, record KeyDir) ([]byte, bool, error) {
+	file, format := reader.file, reader.format
+	payloadStartOffset := record.ValuePos
+	payloadLength := int64(record.ValueSz)
+	if format == formatGob {
+		// Legacy records sit behind an 8-byte length prefix.
+		payloadStartOffset += 8
+		payloadLength -= 8
 	}
-	defer file.Close()
-	payloadStartOffset := record.ValuePos + 8
-	payloadLength := int64(record.ValueSz) - 8
 
 	if payloadLength < 0 { // Sanity check
-		log.Printf("Invalid payload length calculated for record %v", record)
-		return nil, fmt.Errorf("invalid payload length calculated for record %v", record)
+		be.logger.Debug("Invalid payload length calculated for record", "file", file.Name(), "offset", record.ValuePos, "size", record.ValueSz)
+		return nil, false, fmt.Errorf("invalid payload length calculated for record %v", record)
 	}
 
-	buf := make([]byte, uint64(payloadLength))
-	_, err = file.ReadAt(buf, payloadStartOffset)
-	if err != nil {
-		log.Printf("Unable to read the buffer at offset '%d' with size '%d': '%v'", record.ValuePos, record.ValueSz, err)
-		return nil, fmt.Errorf("unable to read buffer at offset '%d' with size '%d': %w", record.ValuePos, record.ValueSz, err)
+	var buf []byte
+	var err error
+	if reader.data != nil {
+		if payloadStartOffset < 0 || payloadStartOffset+payloadLength > int64(len(reader.data)) {
+			be.logger.Debug("Record runs past the end of mapped file", "file", file.Name(), "offset", record.ValuePos, "size", record.ValueSz)
+			return nil, false, &CorruptionError{FileID: file.Name(), Offset: record.ValuePos, Err: fmt.Errorf("record runs past the end of the file")}
+		}
+		buf = reader.data[payloadStartOffset : payloadStartOffset+payloadLength]
+	} else {
+		buf = make([]byte, uint64(payloadLength))
+		_, err = file.ReadAt(buf, payloadStartOffset)
+		if err != nil {
+			be.logger.Debug("Unable to read record", "file", file.Name(), "offset", record.ValuePos, "size", record.ValueSz, "error", err)
+			return nil, false, fmt.Errorf("unable to read buffer at offset '%d' with size '%d': %w", record.ValuePos, record.ValueSz, err)
+		}
 	}
 
-	fileEntry, err := DeserializeFileEntry(buf)
+	if format == formatGob {
+		fileEntry, err := deserializeGobFileEntry(buf)
+		if err != nil {
+			be.logger.Debug("Unable to decode record", "file", file.Name(), "offset", record.ValuePos, "error", err)
+			return nil, false, &CorruptionError{FileID: file.Name(), Offset: record.ValuePos, Err: err}
+		}
+		return []byte(fileEntry.Value), fileEntry.IsTombstone, nil
+	}
+
+	header, _, value, err := decodeRecord(buf)
 	if err != nil {
-		log.Printf("Failed to deserialize file entry: %v", err)
-		return nil, fmt.Errorf("failed to deserialize file entry: %w", err)
+		be.logger.Debug("Unable to decode record", "file", file.Name(), "offset", record.ValuePos, "error", err)
+		return nil, false, &CorruptionError{FileID: file.Name(), Offset: record.ValuePos, Err: err}
+	}
+	if header.isTombstone() {
+		return nil, true, nil
 	}
-	return &fileEntry, nil
+	if reader.data != nil {
+		// The mapping goes away once the file is merged, so hand out a copy.
+		value = bytes.Clone(value)
+	}
+	return value, false, nil
 }
 
+// checkWritable returns ErrClosed once the engine is closed, and ErrReadOnly
+// if it was opened read-only. Every write method checks it first, so a closed
+// engine reports ErrClosed whatever its mode.
+func (be *BitcaskEngine) checkWritable() error {
+	be.mu.RLock()
+	defer be.mu.RUnlock()
+
+	if be.closed {
+		return ErrClosed
+	}
+	if be.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Put stores value under key. When it returns depends on the sync policy,
+// which also decides whether other readers may see the value before it is
+// durable.
 func (be *BitcaskEngine) Put(key, value string) error {
-	be.mu.Lock()
-	defer be.mu.Unlock()
+	if err := be.checkWritable(); err != nil {
+		return err
+	}
+
+	record, err := encodeRecord(key, value, false)
+	if err != nil {
+		be.logger.Debug("Unable to encode record", be.keyAttr(key), "error", err)
+		return fmt.Errorf("failed to create file entry: %w", err)
+	}
+	return be.put(record)
+}
 
-	fileEntry, err := NewFileEntry(key, value, false)
+// PutBytes is Put for binary keys and values. Both are encoded straight into
+// the record written to disk, and the engine keeps no reference to value once
+// PutBytes returns.
+func (be *BitcaskEngine) PutBytes(key, value []byte) error {
+	if err := be.checkWritable(); err != nil {
+		return err
+	}
+
+	record, err := encodeRecord(key, value, false)
 	if err != nil {
-		log.Printf("Failed to create new file entry for key '%s': %v", key, err)
+		be.logger.Debug("Unable to encode record", be.keyAttr(string(key)), "error", err)
 		return fmt.Errorf("failed to create file entry: %w", err)
 	}
+	return be.put(record)
+}
 
-	keydirEntry, err := be.putFileEntry(fileEntry)
+func (be *BitcaskEngine) put(record *encodedRecord) error {
+	err := be.commit(&writeRequest{records: []*encodedRecord{record}})
+	if err == ErrClosed {
+		return err
+	}
 	if err != nil {
-		log.Printf("Unable to insert key '%s' and value '%s' into disk: %v", key, value, err)
+		be.logger.Error("Unable to write record", be.keyAttr(record.key), "error", err)
 		return fmt.Errorf("unable to insert key-value pair into disk: %w", err)
 	}
-	be.Keydir[key] = keydirEntry
 	return nil
 }
 
 func (be *BitcaskEngine) Delete(key string) error {
-	be.mu.Lock()
-	defer be.mu.Unlock()
-
-	if _, ok := be.Keydir[key]; !ok {
-		log.Printf("Attempted to delete non-existent key '%s'", key)
-		// NOTE: I'm unsure if this is an error or not
-		return fmt.Errorf("key '%s' not found for deletion", key)
+	if err := be.checkWritable(); err != nil {
+		return err
 	}
 
-	tombstoneEntry, err := NewFileEntry(key, "", true)
+	tombstoneEntry, err := encodeRecord(key, "", true)
 	if err != nil {
-		log.Printf("Failed to create tombstone entry for key '%s': '%v'", key, err)
-		return fmt.Errorf("failed to create tombstone entry for key '%s': %w", key, err)
+		be.logger.Debug("Unable to encode tombstone", be.keyAttr(key), "error", err)
+		return fmt.Errorf("failed to create tombstone entry: %w", err)
 
 	}
-	_, err = be.putFileEntry(tombstoneEntry)
+
+	err = be.commit(&writeRequest{
+		records: []*encodedRecord{tombstoneEntry},
+		check: func() error {
+			record, ok := be.keydir.Get(key)
+			if !ok || record.expiredAt(time.Now().UnixNano()) {
+				// NOTE: I'm unsure if this is an error or not
+				return ErrKeyNotFound
+			}
+			return nil
+		},
+	})
+	if errors.Is(err, ErrKeyNotFound) {
+		be.logger.Debug("Attempted to delete non-existent key", be.keyAttr(key))
+		return err
+	}
+	if err == ErrClosed {
+		return err
+	}
 	if err != nil {
-		log.Printf("Unable to put tombstone value into disk for key '%s': %v", key, err)
+		be.logger.Error("Unable to write tombstone", be.keyAttr(key), "error", err)
 		return fmt.Errorf("unable to put tombstone value into disk: %w", err)
 	}
-	delete(be.Keydir, key)
-	log.Printf("Key '%s' successfully marked as deleted and removed from keydir", key)
+	be.logger.Debug("Key deleted", be.keyAttr(key))
 	return nil
 }
 
-func (be *BitcaskEngine) putFileEntry(fileEntry *FileEntry) (*KeyDir, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(fileEntry)
+func (be *BitcaskEngine) putFileEntry(record *encodedRecord) (KeyDir, error) {
+	offset, err := be.appendToActiveFile(record.buf)
 	if err != nil {
-		log.Printf("Failed to encode file entry: %v", err)
-		return nil, fmt.Errorf("failed to encode file entry: %w", err)
+		return KeyDir{}, err
 	}
+	return be.recordWritten(record, offset), nil
+}
 
-	serializedFileEntryBytes := buf.Bytes()
-	payloadLen := uint64(len(serializedFileEntryBytes))
-	lenBuf := make([]byte, 8)
-	binary.BigEndian.PutUint64(lenBuf, payloadLen)
+// putBatch appends records framed as a single batch record, so they either
+// all survive a crash or none of them does.
+func (be *BitcaskEngine) putBatch(records []*encodedRecord) ([]KeyDir, error) {
+	buf, err := encodeBatch(records, records[len(records)-1].tstamp)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := be.appendToActiveFile(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	keydirEntries := make([]KeyDir, len(records))
+	recordOffset := offset + recordHeaderSize
+	for i, record := range records {
+		keydirEntries[i] = be.recordWritten(record, recordOffset)
+		recordOffset += int64(len(record.buf))
+	}
+	return keydirEntries, nil
+}
 
-	totalLen := int64(8 + payloadLen)
+// appendToActiveFile writes buf to the end of the active file, rolling over
+// first if it would not fit, and returns the offset it was written at.
+func (be *BitcaskEngine) appendToActiveFile(buf []byte) (int64, error) {
+	totalLen := int64(len(buf))
 
 	// Check if file rollover is needed
 	fileInfo, err := be.ActiveFile.Stat()
 	if err != nil {
-		log.Printf("Cannot stat active file: %v", err)
-		return nil, fmt.Errorf("cannot stat active file: %w", err)
+		be.logger.Debug("Unable to stat active file", "error", err)
+		return 0, fmt.Errorf("cannot stat active file: %w", err)
 	}
 
-	if fileInfo.Size()+totalLen > be.MaxFileSize {
-		log.Printf("Active file size %d bytes, rolling over to new file. Current entry size: %d bytes. MaxFileSize is %d", fileInfo.Size(), totalLen, be.MaxFileSize)
+	if fileInfo.Size() > fileHeaderSize && fileInfo.Size()+totalLen > be.MaxFileSize {
+		be.logger.Debug("Active file is full, rolling over", "size", fileInfo.Size(), "record_size", totalLen, "max_file_size", be.MaxFileSize)
 		err := be.rollOverActiveFile()
 		if err != nil {
-			log.Printf("Failed to roll over active file: %v", err)
-			return nil, fmt.Errorf("failed to roll over active file: %w", err)
+			be.logger.Error("Unable to roll over active file", "error", err)
+			return 0, fmt.Errorf("failed to roll over active file: %w", err)
 		}
 	}
 
 	offset, err := be.ActiveFile.Seek(0, io.SeekCurrent)
 	if err != nil {
-		log.Printf("Unable to get current file offset: '%v'", err)
-		return nil, fmt.Errorf("unable to get current file offset: %w", err)
+		be.logger.Debug("Unable to get current file offset", "error", err)
+		return 0, fmt.Errorf("unable to get current file offset: %w", err)
 	}
 
-	_, err = be.ActiveFile.Write(lenBuf)
+	nbytes, err := be.writeFile(be.ActiveFile, buf)
 	if err != nil {
-		log.Printf("Unable to write the correct buffer length for the file entry: %v", err)
-		return nil, fmt.Errorf("unable to write length prefix: %w", err)
+		be.logger.Debug("Unable to write to active file", "error", err)
+		be.discardPartialWrite(offset)
+		return 0, fmt.Errorf("unable to write file entry: %w", err)
 	}
 
-	nbytes, err := be.ActiveFile.Write(serializedFileEntryBytes)
-	if err != nil {
-		log.Printf("Unable to write to file: '%v'", err)
-		return nil, fmt.Errorf("unable to write file entry payload: %w", err)
+	if int64(nbytes) != totalLen {
+		be.logger.Debug("Short write to active file", "record_size", totalLen, "written", nbytes)
+		be.discardPartialWrite(offset)
+		return 0, fmt.Errorf("write size mismatch: expected %d bytes, wrote %d", totalLen, nbytes)
 	}
+	be.files.addRecords(be.activeFileID, totalLen)
+	return offset, nil
+}
 
-	if uint64(nbytes) != payloadLen {
-		log.Printf("Mismatch between payload length '%d' and bytes written '%d'", payloadLen, nbytes)
-		return nil, fmt.Errorf("write size mismatch: expected %d bytes, wrote %d", payloadLen, nbytes)
+// discardPartialWrite cuts the active file back to offset after a failed
+// write, so later records follow the intact ones and a torn record can only
+// ever be found at the tail of a file.
+func (be *BitcaskEngine) discardPartialWrite(offset int64) {
+	// A mapping must never outlive the end of its file.
+	be.readers.evict(be.ActiveFile.Name())
+	if err := be.ActiveFile.Truncate(offset); err != nil {
+		be.logger.Error("Unable to drop partial write from active file", "offset", offset, "error", err)
+		return
 	}
+	if _, err := be.ActiveFile.Seek(offset, io.SeekStart); err != nil {
+		be.logger.Error("Unable to seek active file after dropping partial write", "offset", offset, "error", err)
+	}
+}
 
-	keydirEntry := &KeyDir{
-		FileID:   be.ActiveFile.Name(),
-		ValueSz:  uint64(8 + nbytes),
+// recordWritten returns the keydir entry of a record just written to the
+// active file at offset and adds it to the active file's hints.
+func (be *BitcaskEngine) recordWritten(record *encodedRecord, offset int64) KeyDir {
+	keydirEntry := KeyDir{
+		FileID:   be.activeFileID,
+		ValueSz:  uint32(len(record.buf)),
 		ValuePos: offset,
-		Tstamp:   fileEntry.Tstamp,
+		Tstamp:   record.tstamp,
+		Expiry:   record.expiry,
+	}
+	if record.expiry != 0 {
+		be.hasExpiring = true
 	}
 
-	return keydirEntry, nil
+	if be.collectHints {
+		be.activeHints = appendHintEntry(be.activeHints, hintEntry{
+			key:         record.key,
+			tstamp:      record.tstamp,
+			expiry:      record.expiry,
+			isTombstone: record.isTombstone,
+			recordSize:  uint64(keydirEntry.ValueSz),
+			recordPos:   offset,
+		})
+	}
+	return keydirEntry
 }
 
 func (be *BitcaskEngine) rollOverActiveFile() error {
 	if be.ActiveFile != nil {
-		log.Printf("Closing active file: %s", be.ActiveFile.Name())
-		err := be.ActiveFile.Close()
+		be.logger.Debug("Closing active file", "file", be.ActiveFile.Name())
+		be.writeActiveHint()
+		var err error
+		if be.syncPolicy != SyncNever {
+			err = be.ActiveFile.Sync()
+			be.unsyncedWrites = 0
+		}
+		if closeErr := be.ActiveFile.Close(); err == nil {
+			err = closeErr
+		}
 		if err != nil {
-			log.Printf("Error closing old active file '%s': %v", be.ActiveFile.Name(), err)
+			be.logger.Error("Unable to close old active file", "file", be.ActiveFile.Name(), "error", err)
 			// Decide if this is a critical error or just log and proceed. For now, we'll return.
 			return fmt.Errorf("error closing old active file: %w", err)
 		}
+		// The file is immutable from now on, so its reader can be reopened as a mapping.
+		be.readers.evict(be.ActiveFile.Name())
 	}
 
-	filename := fmt.Sprintf("%d.data", time.Now().Unix())
-	activeFilePath := filepath.Join(be.ActiveDir, filename)
-
-	// Original fmt.Printf commented out
-	log.Printf("Chosen new active file name is %s", activeFilePath)
-
-	newActiveFile, err := os.OpenFile(activeFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	activeFilePath := be.nextDataFilePath()
+	newActiveFile, err := openDataFile(activeFilePath)
 	if err != nil {
-		log.Printf("Unable to roll over to new active file '%s': '%v'", activeFilePath, err)
+		be.logger.Error("Unable to open new active file", "file", activeFilePath, "error", err)
 		return fmt.Errorf("unable to open new active file '%s': %w", activeFilePath, err)
 	}
-	be.ActiveFile = newActiveFile
-	log.Printf("Successfully rolled over to new active file: %s", newActiveFile.Name())
+	be.setActiveFile(newActiveFile)
+	be.logger.Info("Rolled over to new active file", "file", newActiveFile.Name())
 	return nil
 }
 
+// openDataFile opens a data file for appending, writing the format header if
+// the file is new. The returned file is positioned at its end so the offset of
+// the next record can be read with Seek.
+func openDataFile(filePath string) (*os.File, error) {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := detectFileFormat(file)
+	if err == nil && format != currentFormat {
+		err = fmt.Errorf("cannot append to '%s' written in format %d", filePath, format)
+	}
+	if err == nil {
+		var offset int64
+		offset, err = file.Seek(0, io.SeekEnd)
+		if err == nil && offset == 0 {
+			_, err = file.Write(encodeFileHeader(currentFormat))
+			if err == nil {
+				// Make sure the new file itself survives a crash.
+				err = syncDir(filepath.Dir(filePath))
+			}
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// setActiveFile switches writes over to file. Hints are only collected for a
+// file that starts out empty, since they would otherwise miss its earlier records.
+func (be *BitcaskEngine) setActiveFile(file *os.File) {
+	offset, err := file.Seek(0, io.SeekCurrent)
+	be.ActiveFile = file
+	be.activeFileID = be.files.add(file.Name())
+	be.activeHints = be.activeHints[:0]
+	be.collectHints = err == nil && offset <= fileHeaderSize
+}
+
+// writeActiveHint writes the hint file of the active file right before it
+// becomes immutable. Hints only speed up BuildIndex, so failures are logged
+// rather than returned.
+func (be *BitcaskEngine) writeActiveHint() {
+	if !be.collectHints {
+		return
+	}
+	fileInfo, err := be.ActiveFile.Stat()
+	if err != nil {
+		be.logger.Warn("Unable to stat active file for its hint file", "file", be.ActiveFile.Name(), "error", err)
+		return
+	}
+	if err := writeHintFile(be.ActiveFile.Name(), fileInfo.Size(), be.activeHints); err != nil {
+		be.logger.Warn("Unable to write hint file", "file", be.ActiveFile.Name(), "error", err)
+	}
+}
+
+// keyAttr is the log attribute for key, which stays redacted unless
+// Options.LogKeys is set.
+func (be *BitcaskEngine) keyAttr(key string) slog.Attr {
+	if !be.logKeys {
+		return slog.String("key", redactedKey)
+	}
+	return slog.String("key", key)
+}
+
 func (be *BitcaskEngine) BuildIndex() error {
-	directoryEntries, err := os.ReadDir(be.ActiveDir)
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	if be.closed {
+		return ErrClosed
+	}
+
+	dataFiles, err := be.listDataFiles()
 	if err != nil {
-		log.Printf("Unable to get all the subdirectories of '%s': %v", be.ActiveDir, err)
-		return fmt.Errorf("unable to read directory '%s': %w", be.ActiveDir, err)
+		be.logger.Error("Unable to list data files", "dir", be.ActiveDir, "error", err)
+		return err
 	}
 
-	sort.Slice(directoryEntries, func(i, j int) bool {
-		fileI := strings.TrimSuffix(directoryEntries[i].Name(), ".data")
-		fileJ := strings.TrimSuffix(directoryEntries[j].Name(), ".data")
+	for _, filePath := range dataFiles {
+		if fileID, err := parseFileID(filePath); err == nil {
+			be.lastFileID = max(be.lastFileID, fileID)
+		}
+	}
 
-		tsI, errI := strconv.ParseInt(fileI, 10, 64)
-		tsJ, errJ := strconv.ParseInt(fileJ, 10, 64)
+	// Only the newest file holding records can end in a torn write.
+	tailFile := ""
+	for i := len(dataFiles) - 1; i >= 0 && tailFile == ""; i-- {
+		fileInfo, err := os.Stat(dataFiles[i])
+		if err != nil {
+			be.logger.Error("Unable to stat data file", "file", dataFiles[i], "error", err)
+			return fmt.Errorf("unable to stat file '%s': %w", dataFiles[i], err)
+		}
+		if fileInfo.Size() > fileHeaderSize {
+			tailFile = dataFiles[i]
+		}
+	}
 
-		if errI != nil || errJ != nil {
-			log.Printf("Warning: Non-timestamp filename found, falling back to lexicographical sort: %s or %s", directoryEntries[i].Name(), directoryEntries[j].Name())
-			return directoryEntries[i].Name() < directoryEntries[j].Name()
+	// A checkpoint can only stand in for the data files on an empty keydir,
+	// and Repair has to scan them to find corruption.
+	var covered int64
+	if be.keydir.Len() == 0 && !be.Repair {
+		covered, err = be.loadCheckpoint(dataFiles)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			be.logger.Warn("Ignoring keydir checkpoint", "dir", be.ActiveDir, "error", err)
+		} else if err == nil {
+			be.logger.Debug("Loaded keydir checkpoint", "dir", be.ActiveDir, "keys", be.keydir.Len(), "last_file_id", covered)
 		}
-		return tsI < tsJ
-	})
+	}
 
-	for _, fileInfo := range directoryEntries {
-		if fileInfo.IsDir() || !strings.HasSuffix(fileInfo.Name(), ".data") {
+	var replay []string
+	for _, filePath := range dataFiles {
+		if fileID, err := parseFileID(filePath); err == nil && fileID <= covered {
 			continue
 		}
+		replay = append(replay, filePath)
+	}
+	if err := be.scanDataFiles(replay, tailFile); err != nil {
+		return err
+	}
 
-		filePath := filepath.Join(be.ActiveDir, fileInfo.Name())
-		err = be.processOldFile(filePath)
+	// Files may have been truncated while scanning, so their sizes are only
+	// final now.
+	for _, filePath := range dataFiles {
+		fileInfo, err := os.Stat(filePath)
 		if err != nil {
-			log.Printf("Failed processing of file '%s': %v", fileInfo.Name(), err)
-			return fmt.Errorf("failed processing file '%s': %w", fileInfo.Name(), err)
+			be.logger.Error("Unable to stat data file", "file", filePath, "error", err)
+			return fmt.Errorf("unable to stat file '%s': %w", filePath, err)
+		}
+		if fileID, ok := be.files.lookup(filePath); ok {
+			be.files.setRecords(fileID, max(0, fileInfo.Size()-fileHeaderSize))
 		}
 	}
 
-	log.Println("Index built successfully.")
+	be.logger.Info("Index built", "dir", be.ActiveDir, "keys", be.keydir.Len(), "files", len(dataFiles))
 	return nil
 }
 
-func (be *BitcaskEngine) processOldFile(filePath string) error {
-	log.Printf("Processing file '%s'", filePath)
+// listDataFiles returns the paths of every .data file in the store, oldest first.
+func (be *BitcaskEngine) listDataFiles() ([]string, error) {
+	directoryEntries, err := os.ReadDir(be.ActiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read directory '%s': %w", be.ActiveDir, err)
+	}
+
+	var dataFiles []string
+	for _, fileInfo := range directoryEntries {
+		if fileInfo.IsDir() || !strings.HasSuffix(fileInfo.Name(), ".data") {
+			continue
+		}
+		dataFiles = append(dataFiles, filepath.Join(be.ActiveDir, fileInfo.Name()))
+	}
+
+	sort.Slice(dataFiles, func(i, j int) bool {
+		tsI, errI := parseFileID(dataFiles[i])
+		tsJ, errJ := parseFileID(dataFiles[j])
+
+		if errI != nil || errJ != nil {
+			be.logger.Warn("Non-numeric data file name, falling back to lexicographical order", "file", dataFiles[i], "other", dataFiles[j])
+			return dataFiles[i] < dataFiles[j]
+		}
+		return tsI < tsJ
+	})
+	return dataFiles, nil
+}
+
+// parseFileID extracts the numeric ID from a data file path such as "dir/1700000000.data".
+func parseFileID(filePath string) (int64, error) {
+	return strconv.ParseInt(strings.TrimSuffix(filepath.Base(filePath), ".data"), 10, 64)
+}
+
+// nextDataFilePath names a new data file after the current time in Unix
+// nanoseconds, or after the highest existing ID plus one if that is not
+// larger, so no two files ever share an ID and newer files sort last. Files
+// from before nanosecond IDs are named in Unix seconds and sort first. The
+// caller must hold be.mu exclusively or have the engine to itself.
+func (be *BitcaskEngine) nextDataFilePath() string {
+	fileID := time.Now().UnixNano()
+	if fileID <= be.lastFileID {
+		fileID = be.lastFileID + 1
+	}
+	be.lastFileID = fileID
+	return filepath.Join(be.ActiveDir, fmt.Sprintf("%d.data", fileID))
+}
+
+// recordSequence returns the sequence number of a record read from a data
+// file of the given format.
+func recordSequence(format uint32, tstamp int64) int64 {
+	if format < formatBinaryV4 {
+		return legacySequence(tstamp)
+	}
+	return tstamp
+}
+
+// processOldFile collects the records of a data file into scan by scanning
+// the file. recoverTail allows a damaged last record to be truncated away.
+func (be *BitcaskEngine) processOldFile(scan *fileScan, filePath string, recoverTail bool) error {
+	be.logger.Debug("Processing data file", "file", filePath)
 	file, err := os.Open(filePath)
 	if err != nil {
-		log.Printf("Unable to open file '%s': %v", filePath, err)
+		be.logger.Debug("Unable to open data file", "file", filePath, "error", err)
 		return fmt.Errorf("unable to open file '%s': %w", filePath, err)
 	}
 	defer file.Close()
 
-	currentOffset := int64(0)
+	format, err := detectFileFormat(file)
+	if err != nil {
+		be.logger.Debug("Unable to detect data file format", "file", filePath, "error", err)
+		return err
+	}
 
-	for {
-		lenBuf := make([]byte, 8)
-		n, err := io.ReadFull(file, lenBuf)
-		if err == io.EOF {
-			break // End of file, no more records
+	fileInfo, err := file.Stat()
+	if err != nil {
+		be.logger.Debug("Unable to stat data file", "file", filePath, "error", err)
+		return fmt.Errorf("unable to stat file '%s': %w", filePath, err)
+	}
+	fileSize := fileInfo.Size()
+
+	if format == formatGob {
+		return be.processGobFile(scan, file, fileSize, recoverTail)
+	}
+
+	reader := bufio.NewReader(file)
+	if _, err := reader.Discard(fileHeaderSize); err == io.EOF {
+		return nil // Empty file, the header has not been written yet
+	} else if err != nil {
+		be.logger.Debug("Unable to skip data file header", "file", filePath, "error", err)
+		return fmt.Errorf("error skipping file header of '%s': %w", filePath, err)
+	}
+
+	currentOffset := int64(fileHeaderSize)
+	headerBuf := make([]byte, recordHeaderSize)
+
+	for currentOffset < fileSize {
+		if fileSize-currentOffset < recordHeaderSize {
+			be.logger.Debug("Truncated record header", "file", filePath, "offset", currentOffset)
+			return be.handleCorruption(&CorruptionError{FileID: filePath, Offset: currentOffset, Err: fmt.Errorf("truncated record header")}, recoverTail)
 		}
-		if err != nil {
-			log.Printf("Error reading length prefix from '%s' at offset %d: %v", filePath, currentOffset, err)
-			return fmt.Errorf("error reading length prefix from '%s' at offset %d: %w", filePath, currentOffset, err)
+		if _, err := io.ReadFull(reader, headerBuf); err != nil {
+			be.logger.Debug("Unable to read record header", "file", filePath, "offset", currentOffset, "error", err)
+			return fmt.Errorf("error reading record header from '%s' at offset %d: %w", filePath, currentOffset, err)
+		}
+
+		header := decodeRecordHeader(headerBuf)
+		if header.isBatch() && format < formatBinaryV2 {
+			be.logger.Debug("Batch record in a file without batch support", "file", filePath, "offset", currentOffset)
+			return be.handleCorruption(&CorruptionError{FileID: filePath, Offset: currentOffset, Err: fmt.Errorf("batch record in a format %d file", format)}, false)
+		}
+		if header.expires && format < formatBinaryV3 {
+			be.logger.Debug("Expiring record in a file without expiry support", "file", filePath, "offset", currentOffset)
+			return be.handleCorruption(&CorruptionError{FileID: filePath, Offset: currentOffset, Err: fmt.Errorf("expiring record in a format %d file", format)}, false)
+		}
+		recordTotalSize := recordHeaderSize + header.payloadSize()
+		if !header.isBatch() && recordTotalSize > math.MaxUint32 {
+			be.logger.Debug("Record too large to index", "file", filePath, "offset", currentOffset, "size", recordTotalSize)
+			return be.handleCorruption(&CorruptionError{FileID: filePath, Offset: currentOffset, Err: fmt.Errorf("record of %d bytes is too large to index", recordTotalSize)}, false)
 		}
-		if n != 8 {
-			log.Printf("Short read for length prefix in '%s' at offset %d, expected 8 bytes, got %d", filePath, currentOffset, n)
-			return fmt.Errorf("short read for length prefix in '%s' at offset %d, expected 8 bytes, got %d", filePath, currentOffset, n)
+		if currentOffset+recordTotalSize > fileSize {
+			be.logger.Debug("Record runs past the end of the file", "file", filePath, "offset", currentOffset, "size", recordTotalSize, "remaining", fileSize-currentOffset)
+			return be.handleCorruption(&CorruptionError{FileID: filePath, Offset: currentOffset, Err: fmt.Errorf("record of %d bytes runs past the end of the file", recordTotalSize)}, recoverTail)
 		}
 
-		payloadLen := binary.BigEndian.Uint64(lenBuf)
+		payloadBuf := make([]byte, header.payloadSize())
+		if _, err := io.ReadFull(reader, payloadBuf); err != nil {
+			be.logger.Debug("Unable to read record payload", "file", filePath, "offset", currentOffset, "size", len(payloadBuf), "error", err)
+			return fmt.Errorf("error reading payload from '%s' at offset %d (payload length %d): %w", filePath, currentOffset, len(payloadBuf), err)
+		}
+
+		crc := crc32.Update(crc32.ChecksumIEEE(headerBuf[4:]), crc32.IEEETable, payloadBuf)
+		if crc != header.crc {
+			be.logger.Debug("Checksum mismatch", "file", filePath, "offset", currentOffset)
+			atTail := currentOffset+recordTotalSize == fileSize
+			return be.handleCorruption(&CorruptionError{FileID: filePath, Offset: currentOffset, Err: fmt.Errorf("checksum mismatch (stored %08x, computed %08x)", header.crc, crc)}, recoverTail && atTail)
+		}
+
+		if header.isBatch() {
+			records, err := decodeBatch(payloadBuf)
+			if err != nil {
+				be.logger.Debug("Malformed batch record", "file", filePath, "offset", currentOffset, "error", err)
+				return be.handleCorruption(&CorruptionError{FileID: filePath, Offset: currentOffset, Err: err}, false)
+			}
+			for _, record := range records {
+				scan.add(string(record.key), recordSequence(format, record.header.tstamp), record.expiry, record.header.isTombstone(), currentOffset+recordHeaderSize+record.offset, uint32(record.size))
+			}
+		} else {
+			expiry, key, _ := header.splitPayload(payloadBuf)
+			scan.add(string(key), recordSequence(format, header.tstamp), expiry, header.isTombstone(), currentOffset, uint32(recordTotalSize))
+		}
+		currentOffset += recordTotalSize
+	}
+	return nil
+}
+
+// processGobFile collects the records of a data file written in the legacy
+// gob format, where every record is an 8-byte length prefix and a gob payload.
+func (be *BitcaskEngine) processGobFile(scan *fileScan, file *os.File, fileSize int64, recoverTail bool) error {
+	filePath := file.Name()
+	reader := bufio.NewReader(file)
+	currentOffset := int64(0)
+	lenBuf := make([]byte, 8)
+
+	for currentOffset < fileSize {
 		recordStartOffset := currentOffset
+		if fileSize-currentOffset < 8 {
+			be.logger.Debug("Truncated length prefix", "file", filePath, "offset", currentOffset, "remaining", fileSize-currentOffset)
+			return be.handleCorruption(&CorruptionError{FileID: filePath, Offset: recordStartOffset, Err: fmt.Errorf("truncated length prefix")}, recoverTail)
+		}
+		if _, err := io.ReadFull(reader, lenBuf); err != nil {
+			be.logger.Debug("Unable to read length prefix", "file", filePath, "offset", currentOffset, "error", err)
+			return fmt.Errorf("error reading length prefix from '%s' at offset %d: %w", filePath, currentOffset, err)
+		}
 
+		payloadLen := binary.BigEndian.Uint64(lenBuf)
 		payloadOffset := currentOffset + 8
+		if payloadLen > math.MaxUint32-8 {
+			be.logger.Debug("Record too large to index", "file", filePath, "offset", currentOffset, "size", payloadLen)
+			return be.handleCorruption(&CorruptionError{FileID: filePath, Offset: recordStartOffset, Err: fmt.Errorf("record of %d bytes is too large to index", 8+payloadLen)}, false)
+		}
+		if payloadLen > uint64(fileSize-payloadOffset) {
+			be.logger.Debug("Record runs past the end of the file", "file", filePath, "offset", payloadOffset, "size", payloadLen, "remaining", fileSize-payloadOffset)
+			return be.handleCorruption(&CorruptionError{FileID: filePath, Offset: recordStartOffset, Err: fmt.Errorf("record of %d bytes runs past the end of the file", 8+payloadLen)}, recoverTail)
+		}
 
 		payloadBuf := make([]byte, payloadLen)
-		n, err = io.ReadFull(file, payloadBuf)
-		if err != nil {
-			log.Printf("Error reading payload from '%s' at offset %d (payload length %d): %v", filePath, payloadOffset, payloadLen, err)
+		if _, err := io.ReadFull(reader, payloadBuf); err != nil {
+			be.logger.Debug("Unable to read record payload", "file", filePath, "offset", payloadOffset, "size", payloadLen, "error", err)
 			return fmt.Errorf("error reading payload from '%s' at offset %d (payload length %d): %w", filePath, payloadOffset, payloadLen, err)
 		}
-		if uint64(n) != payloadLen {
-			log.Printf("Short read for payload in '%s' at offset %d, expected %d bytes, got %d", filePath, payloadOffset, payloadLen, n)
-			return fmt.Errorf("short read for payload in '%s' at offset %d, expected %d bytes, got %d", filePath, payloadOffset, payloadLen, n)
-		}
 
-		fe, err := DeserializeFileEntry(payloadBuf)
+		recordTotalSize := uint64(8) + payloadLen
+
+		fe, err := deserializeGobFileEntry(payloadBuf)
 		if err != nil {
-			log.Printf("Error deserializing FileEntry from '%s' at offset %d: %v", filePath, payloadOffset, err)
-			return fmt.Errorf("error deserializing FileEntry from '%s' at offset %d: %w", filePath, payloadOffset, err)
+			be.logger.Debug("Unable to decode record", "file", filePath, "offset", payloadOffset, "error", err)
+			atTail := recordStartOffset+int64(recordTotalSize) == fileSize
+			return be.handleCorruption(&CorruptionError{FileID: filePath, Offset: recordStartOffset, Err: err}, recoverTail && atTail)
 		}
 
-		recordTotalSize := uint64(8) + payloadLen
+		scan.add(fe.Key, legacySequence(fe.Tstamp), 0, fe.IsTombstone, recordStartOffset, uint32(recordTotalSize))
 
-		existingKeyDirEntry, ok := be.Keydir[fe.Key]
+		currentOffset += int64(recordTotalSize)
+	}
+	return nil
+}
 
-		if fe.IsTombstone {
-			if !ok || fe.Tstamp >= existingKeyDirEntry.Tstamp {
-				delete(be.Keydir, fe.Key)
-				log.Printf("Deleted key '%s' from keydir during index build (tombstone from %s)", fe.Key, filePath)
-			} else {
-				log.Printf("Skipping older tombstone for key '%s' from %s", fe.Key, filePath)
-			}
-		} else {
-			if !ok || fe.Tstamp >= existingKeyDirEntry.Tstamp {
-				be.Keydir[fe.Key] = &KeyDir{
-					FileID:   filePath,
-					ValueSz:  recordTotalSize,
-					ValuePos: recordStartOffset, // Offset of the start of this complete record (including length prefix)
-					Tstamp:   fe.Tstamp,
-				}
-				log.Printf("Updated keydir for '%s' from file '%s'", fe.Key, filePath)
-			} else {
-				log.Printf("Skipping older entry for key '%s' from %s (current timestamp %d, existing timestamp %d)", fe.Key, filePath, fe.Tstamp, existingKeyDirEntry.Tstamp)
-			}
-		}
+// handleCorruption deals with a corrupted record found while rebuilding the
+// index. A torn write at the tail of the newest file, or any corruption when
+// Repair is set, is truncated away together with everything after it. A
+// read-only engine leaves the file alone and just skips those records. All
+// other corruption is returned as is.
+func (be *BitcaskEngine) handleCorruption(corruption *CorruptionError, isTornWrite bool) error {
+	if !isTornWrite && !be.Repair {
+		return corruption
+	}
+	if be.readOnly {
+		be.logger.Warn("Ignoring the rest of a data file after a damaged record", "file", corruption.FileID, "offset", corruption.Offset, "error", corruption.Err)
+		return nil
+	}
 
-		currentOffset += int64(recordTotalSize)
+	be.logger.Warn("Truncating data file to drop a damaged record", "file", corruption.FileID, "offset", corruption.Offset, "error", corruption.Err)
+	// A mapping must never outlive the end of its file.
+	be.readers.evict(corruption.FileID)
+	if err := os.Truncate(corruption.FileID, corruption.Offset); err != nil {
+		be.logger.Error("Unable to truncate data file", "file", corruption.FileID, "error", err)
+		return fmt.Errorf("unable to truncate '%s' after %w", corruption.FileID, corruption)
+	}
+	// Drop any hint describing the old contents.
+	if err := os.Remove(hintPath(corruption.FileID)); err != nil && !os.IsNotExist(err) {
+		be.logger.Warn("Unable to remove stale hint file", "file", corruption.FileID, "error", err)
+	}
+
+	// Appends through a reopened active file must land at the new end.
+	if be.ActiveFile != nil && be.ActiveFile.Name() == corruption.FileID {
+		if _, err := be.ActiveFile.Seek(0, io.SeekEnd); err != nil {
+			return fmt.Errorf("unable to seek active file after truncation: %w", err)
+		}
 	}
 	return nil
 }
+
+// indexRecord applies a single record found while rebuilding the index,
+// keeping whichever version of the key has the highest sequence number. Only
+// records written before sequence numbers existed can tie, in which case the
+// one read last wins.
+func (be *BitcaskEngine) indexRecord(fileID uint32, key string, tstamp, expiry int64, isTombstone bool, recordStartOffset int64, recordTotalSize uint32) {
+	be.sequence = max(be.sequence, tstamp)
+	existingKeyDirEntry, ok := be.keydir.Get(key)
+	if ok && tstamp < existingKeyDirEntry.Tstamp {
+		return // An older version of the key
+	}
+	if ok {
+		be.files.addLive(existingKeyDirEntry.FileID, -int64(existingKeyDirEntry.ValueSz))
+	}
+
+	// An expired record still hides every older version of its key.
+	if isTombstone || (expiry != 0 && expiry <= time.Now().UnixNano()) {
+		be.keydir.Delete(key)
+		return
+	}
+	be.files.addLive(fileID, int64(recordTotalSize))
+	be.keydir.Set(key, KeyDir{
+		FileID:   fileID,
+		ValueSz:  recordTotalSize,
+		ValuePos: recordStartOffset, // Offset of the start of this complete record
+		Tstamp:   tstamp,
+		Expiry:   expiry,
+	})
+	if expiry != 0 {
+		be.hasExpiring = true
+	}
+}
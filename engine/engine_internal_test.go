@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFailedWriteTruncated checks that a record only partly written before
+// an error is cut off again, instead of ending up in the middle of the file
+// once later records follow it.
+func TestFailedWriteTruncated(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{MergeCheckInterval: -1, Logger: slog.New(slog.DiscardHandler)}
+
+	be, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open engine: %v", err)
+	}
+	if err := be.Put("first", "value"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	dataFile := be.ActiveFile.Name()
+	intactInfo, err := os.Stat(dataFile)
+	if err != nil {
+		t.Fatalf("Failed to stat data file: %v", err)
+	}
+
+	errDiskFull := errors.New("disk full")
+	failures := map[string]func(*os.File, []byte) (int, error){
+		"error": func(f *os.File, p []byte) (int, error) {
+			n, _ := f.Write(p[:len(p)/2])
+			return n, errDiskFull
+		},
+		"short write": func(f *os.File, p []byte) (int, error) {
+			return f.Write(p[:len(p)-1])
+		},
+	}
+	for name, write := range failures {
+		be.writeFile = write
+		if err := be.Put("lost", "value"); err == nil {
+			t.Fatalf("Expected Put to fail on %s", name)
+		}
+		be.writeFile = (*os.File).Write
+
+		info, err := os.Stat(dataFile)
+		if err != nil {
+			t.Fatalf("Failed to stat data file: %v", err)
+		}
+		if info.Size() != intactInfo.Size() {
+			t.Errorf("Expected the partial record to be dropped after %s, file has %d bytes instead of %d", name, info.Size(), intactInfo.Size())
+		}
+	}
+
+	if err := be.Put("second", "value"); err != nil {
+		t.Fatalf("Put after failed writes failed: %v", err)
+	}
+	be.Close()
+
+	// Rebuilding from the records must not find any corruption.
+	os.Remove(filepath.Join(dir, checkpointFileName))
+	os.Remove(hintPath(dataFile))
+	reopened, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen engine: %v", err)
+	}
+	defer reopened.Close()
+	for _, key := range []string{"first", "second"} {
+		if value, err := reopened.Get(key); err != nil || value != "value" {
+			t.Errorf("Get(%s) = %q, %v; want %q", key, value, err, "value")
+		}
+	}
+	if _, err := reopened.Get("lost"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected the failed write to be gone, got %v", err)
+	}
+}
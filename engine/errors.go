@@ -0,0 +1,57 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrKeyNotFound is returned when a key is not in the store, either because it
+// was never written or because it has been deleted.
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrClosed is returned by every operation on an engine after Close.
+var ErrClosed = errors.New("engine is closed")
+
+// ErrKeyTooLarge is returned when a key is too long to be encoded in a record.
+var ErrKeyTooLarge = errors.New("key too large")
+
+// ErrDatabaseLocked is returned by Open when another engine, in this process
+// or another one, holds the lock of the directory.
+var ErrDatabaseLocked = errors.New("database is locked by another engine")
+
+// ErrReadOnly is returned by operations that modify a store opened with
+// Options.ReadOnly.
+var ErrReadOnly = errors.New("engine is read-only")
+
+// ErrCorrupted is matched by every error reporting a record whose checksum or
+// framing does not add up.
+var ErrCorrupted = errors.New("corrupted record")
+
+// CorruptionError reports a corrupted record by data file and offset. It
+// matches ErrCorrupted with errors.Is.
+type CorruptionError struct {
+	FileID string
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted record in '%s' at offset %d: %v", e.FileID, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupted
+}
+
+// ErrConflict is returned by Txn.Commit when another write changed a key the
+// transaction writes after the transaction began. The transaction can be
+// retried from Begin.
+var ErrConflict = errors.New("transaction conflict")
+
+// ErrTxnDone is returned by every operation on a transaction after Commit or
+// Rollback.
+var ErrTxnDone = errors.New("transaction already committed or rolled back")
@@ -2,13 +2,67 @@ package engine
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"hash/crc32"
-	"log"
+	"io"
+	"math"
+	"os"
 	"time"
 )
 
+// Every data file starts with a small header naming the record format it
+// holds, so the layout can evolve while older files stay readable. Files
+// without the header predate it and hold gob-encoded records behind an 8-byte
+// length prefix.
+const (
+	fileMagic      = "BCSK"
+	fileHeaderSize = 8
+
+	formatGob      uint32 = 0
+	formatBinaryV1 uint32 = 1
+	formatBinaryV2 uint32 = 2 // Adds batch records
+	formatBinaryV3 uint32 = 3 // Adds expiring records
+	formatBinaryV4 uint32 = 4 // Stores sequence numbers in place of timestamps
+	currentFormat         = formatBinaryV4
+)
+
+// Records are laid out as
+//
+//	crc (4) | tstamp (8) | ksz (4) | vsz (4) | key | value
+//
+// with every integer big endian. The CRC covers everything after itself.
+// Tombstones carry no value and store tombstoneValueSz in place of the value
+// size.
+//
+// From formatBinaryV2 on, a batch of records written atomically is framed as
+// a single record storing batchKeySz in place of the key size. It has no key
+// and its value is the batch's records laid out one after the other, so the
+// outer CRC covers the whole batch and a torn batch is dropped as a unit.
+//
+// From formatBinaryV3 on, a record written with a TTL sets expiryKeySzFlag in
+// its key size and carries its expiry, in Unix nanoseconds, right after the
+// header:
+//
+//	crc (4) | tstamp (8) | ksz (4) | vsz (4) | expiry (8) | key | value
+//
+// which limits keys to less than 2 GiB.
+//
+// Up to formatBinaryV3, tstamp is the time of the write in Unix seconds, so
+// writes within the same second tie. From formatBinaryV4 on, it holds the
+// record's sequence number instead, which is unique and orders every record
+// ever written to the store; see BitcaskEngine.nextSequence. Timestamps read
+// from older records are converted with legacySequence.
+const (
+	recordHeaderSize = 20
+	tombstoneValueSz = math.MaxUint32
+	batchKeySz       = math.MaxUint32
+	expiryKeySzFlag  = 1 << 31
+	expirySize       = 8
+)
+
+// FileEntry is a decoded record, as stored by the legacy gob format.
 type FileEntry struct {
 	Crc         uint32
 	Tstamp      int64
@@ -19,43 +73,307 @@ type FileEntry struct {
 	IsTombstone bool
 }
 
-func (fe *FileEntry) Serialize() ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(fe)
-	if err != nil {
-		log.Printf("Unable to encode FileEntry into binary: %v", err)
-		return nil, fmt.Errorf("unable to encode FileEntry into binary: %w", err)
+type recordHeader struct {
+	crc     uint32
+	tstamp  int64
+	ksz     uint32
+	vsz     uint32
+	expires bool
+}
+
+func decodeRecordHeader(buf []byte) recordHeader {
+	header := recordHeader{
+		crc:    binary.BigEndian.Uint32(buf[0:4]),
+		tstamp: int64(binary.BigEndian.Uint64(buf[4:12])),
+		ksz:    binary.BigEndian.Uint32(buf[12:16]),
+		vsz:    binary.BigEndian.Uint32(buf[16:20]),
 	}
-	return buf.Bytes(), nil
+	if !header.isBatch() && header.ksz&expiryKeySzFlag != 0 {
+		header.ksz &^= expiryKeySzFlag
+		header.expires = true
+	}
+	return header
 }
 
-func NewFileEntry(key, value string, isTombstone bool) (*FileEntry, error) {
+func (h recordHeader) isTombstone() bool {
+	return !h.isBatch() && h.vsz == tombstoneValueSz
+}
+
+func (h recordHeader) isBatch() bool {
+	return h.ksz == batchKeySz
+}
+
+// payloadSize is the number of expiry, key and value bytes following the
+// header.
+func (h recordHeader) payloadSize() int64 {
+	var size int64
+	if h.expires {
+		size = expirySize
+	}
+	switch {
+	case h.isBatch():
+		return int64(h.vsz)
+	case h.isTombstone():
+		return size + int64(h.ksz)
+	}
+	return size + int64(h.ksz) + int64(h.vsz)
+}
+
+// splitPayload splits the payload of a record that is not a batch into its
+// expiry, zero if the record never expires, key and value.
+func (h recordHeader) splitPayload(payload []byte) (int64, []byte, []byte) {
+	var expiry int64
+	if h.expires {
+		expiry = int64(binary.BigEndian.Uint64(payload[:expirySize]))
+		payload = payload[expirySize:]
+	}
+	return expiry, payload[:h.ksz], payload[h.ksz:]
+}
+
+// encodedRecord is a record serialized for appending to the active file,
+// along with what the keydir and hint file need to know about it.
+type encodedRecord struct {
+	key         string
+	tstamp      int64
+	expiry      int64
+	isTombstone bool
+	buf         []byte
+}
+
+// encodeRecord serializes a record straight from key and value, whether they
+// are strings or byte slices, so neither has to be converted first. The
+// record is incomplete until stamp fills in its sequence number and CRC.
+func encodeRecord[K, V string | []byte](key K, value V, isTombstone bool) (*encodedRecord, error) {
+	return encodeExpiringRecord(key, value, 0, isTombstone)
+}
+
+// encodeExpiringRecord is encodeRecord for a record that expires at expiry,
+// in Unix nanoseconds. An expiry of zero means the record never expires.
+func encodeExpiringRecord[K, V string | []byte](key K, value V, expiry int64, isTombstone bool) (*encodedRecord, error) {
+	if uint64(len(key)) >= expiryKeySzFlag {
+		return nil, fmt.Errorf("%w: key of %d bytes cannot be encoded", ErrKeyTooLarge, len(key))
+	}
+	if uint64(len(value)) >= tombstoneValueSz {
+		return nil, fmt.Errorf("value of %d bytes is too large to encode", len(value))
+	}
+
+	ksz := uint32(len(key))
+	vsz := uint32(len(value))
+	if isTombstone {
+		vsz = tombstoneValueSz
+	}
+	keyOffset := recordHeaderSize
+	if expiry != 0 {
+		ksz |= expiryKeySzFlag
+		keyOffset += expirySize
+	}
+	// The keydir stores the size of every record in 32 bits.
+	if uint64(keyOffset)+uint64(len(key))+uint64(len(value)) > math.MaxUint32 {
+		return nil, fmt.Errorf("record of %d bytes is too large to encode", keyOffset+len(key)+len(value))
+	}
+	buf := make([]byte, keyOffset+len(key)+len(value))
+	binary.BigEndian.PutUint32(buf[12:16], ksz)
+	binary.BigEndian.PutUint32(buf[16:20], vsz)
+	if expiry != 0 {
+		binary.BigEndian.PutUint64(buf[recordHeaderSize:keyOffset], uint64(expiry))
+	}
+	copy(buf[keyOffset:], key)
+	copy(buf[keyOffset+len(key):], value)
+
+	return &encodedRecord{key: string(key), expiry: expiry, isTombstone: isTombstone, buf: buf}, nil
+}
+
+// stamp sets the sequence number of the record and computes its CRC.
+func (r *encodedRecord) stamp(tstamp int64) {
+	r.tstamp = tstamp
+	binary.BigEndian.PutUint64(r.buf[4:12], uint64(tstamp))
+	binary.BigEndian.PutUint32(r.buf[0:4], crc32.ChecksumIEEE(r.buf[4:]))
+}
+
+// legacySequence converts the Unix seconds stored by formats before
+// formatBinaryV4 into a sequence number ordered before every record written
+// later in the same second or after it.
+func legacySequence(tstamp int64) int64 {
+	return tstamp * int64(time.Second)
+}
+
+// encodeBatch frames records as a single batch record.
+func encodeBatch(records []*encodedRecord, tstamp int64) ([]byte, error) {
+	size := 0
+	for _, record := range records {
+		size += len(record.buf)
+	}
+	if uint64(size) >= math.MaxUint32 {
+		return nil, fmt.Errorf("batch of %d bytes is too large to encode", size)
+	}
 
-	tstamp := time.Now().Unix()
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+size)
+	binary.BigEndian.PutUint64(buf[4:12], uint64(tstamp))
+	binary.BigEndian.PutUint32(buf[12:16], batchKeySz)
+	binary.BigEndian.PutUint32(buf[16:20], uint32(size))
+	for _, record := range records {
+		buf = append(buf, record.buf...)
+	}
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf, nil
+}
 
+// legacyChecksum is the CRC the gob format stored, covering only key and value.
+func (fe *FileEntry) legacyChecksum() uint32 {
 	hasher := crc32.NewIEEE()
-	hasher.Write([]byte(key))
-	hasher.Write([]byte(value))
+	io.WriteString(hasher, fe.Key)
+	io.WriteString(hasher, fe.Value)
+	return hasher.Sum32()
+}
 
-	return &FileEntry{
-		Crc:         hasher.Sum32(),
-		Tstamp:      tstamp,
-		Ksz:         uint32(len(key)),
-		ValueSz:     uint32(len(value)),
-		Key:         key,
-		Value:       value,
-		IsTombstone: isTombstone,
-	}, nil
+// NewFileEntry returns a record for key stamped with the current time.
+//
+// Deprecated: the engine encodes records itself and stamps them with sequence
+// numbers; FileEntry only remains to read the legacy gob format.
+func NewFileEntry(key, value string, isTombstone bool) (*FileEntry, error) {
+	record, err := encodeRecord(key, value, isTombstone)
+	if err != nil {
+		return nil, err
+	}
+	record.stamp(time.Now().UnixNano())
+	fe, err := DeserializeFileEntry(record.buf)
+	if err != nil {
+		return nil, err
+	}
+	return &fe, nil
+}
 
+// Serialize encodes fe in the binary record format, without an expiry.
+//
+// Deprecated: the engine encodes records itself; see NewFileEntry.
+func (fe *FileEntry) Serialize() ([]byte, error) {
+	record, err := encodeRecord(fe.Key, fe.Value, fe.IsTombstone)
+	if err != nil {
+		return nil, err
+	}
+	record.stamp(fe.Tstamp)
+	return record.buf, nil
 }
 
+// DeserializeFileEntry verifies and decodes a record in the binary format.
+// The expiry of an expiring record is not part of FileEntry and is dropped.
+//
+// Deprecated: the engine decodes records itself; see NewFileEntry.
 func DeserializeFileEntry(buffer []byte) (FileEntry, error) {
+	header, key, value, err := decodeRecord(buffer)
+	if err != nil {
+		return FileEntry{}, err
+	}
+
+	fe := FileEntry{
+		Crc:         header.crc,
+		Tstamp:      header.tstamp,
+		Ksz:         header.ksz,
+		Key:         string(key),
+		IsTombstone: header.isTombstone(),
+	}
+	if !fe.IsTombstone {
+		fe.ValueSz = header.vsz
+		fe.Value = string(value)
+	}
+	return fe, nil
+}
+
+// decodeRecord verifies a binary record and returns its header along with key
+// and value, which point into buffer rather than being copied out of it.
+func decodeRecord(buffer []byte) (recordHeader, []byte, []byte, error) {
+	if len(buffer) < recordHeaderSize {
+		return recordHeader{}, nil, nil, fmt.Errorf("%w: record of %d bytes is shorter than its %d byte header", ErrCorrupted, len(buffer), recordHeaderSize)
+	}
+	header := decodeRecordHeader(buffer)
+	if int64(len(buffer)) != recordHeaderSize+header.payloadSize() {
+		return recordHeader{}, nil, nil, fmt.Errorf("%w: record of %d bytes does not match its header (ksz %d, vsz %d)", ErrCorrupted, len(buffer), header.ksz, header.vsz)
+	}
+	if header.isBatch() {
+		return recordHeader{}, nil, nil, fmt.Errorf("%w: batch record where a single record was expected", ErrCorrupted)
+	}
+	if crc := crc32.ChecksumIEEE(buffer[4:]); crc != header.crc {
+		return recordHeader{}, nil, nil, fmt.Errorf("%w: checksum mismatch (stored %08x, computed %08x)", ErrCorrupted, header.crc, crc)
+	}
+
+	_, key, value := header.splitPayload(buffer[recordHeaderSize:])
+	return header, key, value, nil
+}
+
+// batchRecord is a record found inside a batch, at offset from the start of
+// the batch's payload.
+type batchRecord struct {
+	offset int64
+	size   int64
+	header recordHeader
+	expiry int64
+	key    []byte
+}
+
+// decodeBatch splits the payload of a batch record into its records. It
+// checks the whole batch before returning any of it, so a batch is either
+// applied completely or not at all.
+func decodeBatch(payload []byte) ([]batchRecord, error) {
+	var records []batchRecord
+	for offset := 0; offset < len(payload); {
+		if len(payload)-offset < recordHeaderSize {
+			return nil, fmt.Errorf("%w: truncated record header in batch at offset %d", ErrCorrupted, offset)
+		}
+		header := decodeRecordHeader(payload[offset:])
+		size := recordHeaderSize + header.payloadSize()
+		if size > int64(len(payload)-offset) {
+			return nil, fmt.Errorf("%w: record in batch at offset %d runs past the end of the batch", ErrCorrupted, offset)
+		}
+		_, key, _, err := decodeRecord(payload[offset : offset+int(size)])
+		if err != nil {
+			return nil, fmt.Errorf("record in batch at offset %d: %w", offset, err)
+		}
+		expiry, _, _ := header.splitPayload(payload[offset+recordHeaderSize : offset+int(size)])
+		records = append(records, batchRecord{offset: int64(offset), size: size, header: header, expiry: expiry, key: key})
+		offset += int(size)
+	}
+	return records, nil
+}
+
+// deserializeGobFileEntry decodes a record written before the binary format
+// existed and verifies its legacy checksum.
+func deserializeGobFileEntry(buffer []byte) (FileEntry, error) {
 	var fe FileEntry
 	dec := gob.NewDecoder(bytes.NewReader(buffer))
 	if err := dec.Decode(&fe); err != nil {
-		log.Printf("Unable to decode FileEntry from buffer: %v", err)
-		return FileEntry{}, fmt.Errorf("unable to decode FileEntry: %w", err)
+		return FileEntry{}, fmt.Errorf("%w: unable to decode FileEntry: %w", ErrCorrupted, err)
+	}
+	if crc := fe.legacyChecksum(); crc != fe.Crc {
+		return FileEntry{}, fmt.Errorf("%w: checksum mismatch (stored %08x, computed %08x)", ErrCorrupted, fe.Crc, crc)
 	}
 	return fe, nil
 }
+
+func encodeFileHeader(format uint32) []byte {
+	buf := make([]byte, fileHeaderSize)
+	copy(buf, fileMagic)
+	binary.BigEndian.PutUint32(buf[4:], format)
+	return buf
+}
+
+// detectFileFormat reports the record format of a data file. Empty files are
+// treated as the current format since they hold no records yet.
+func detectFileFormat(file *os.File) (uint32, error) {
+	buf := make([]byte, fileHeaderSize)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf("unable to read header of '%s': %w", file.Name(), err)
+	}
+	if n == 0 {
+		return currentFormat, nil
+	}
+	if n < fileHeaderSize || string(buf[:len(fileMagic)]) != fileMagic {
+		return formatGob, nil
+	}
+
+	format := binary.BigEndian.Uint32(buf[len(fileMagic):])
+	if format > currentFormat {
+		return 0, fmt.Errorf("unsupported data file format version %d in '%s'", format, file.Name())
+	}
+	return format, nil
+}
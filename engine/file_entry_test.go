@@ -1,7 +1,17 @@
 package engine
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestFileEntry_SerializeDeserialize(t *testing.T) {
@@ -39,3 +49,238 @@ func TestFileEntry_SerializeDeserialize(t *testing.T) {
 		t.Errorf("Value mismatch: got %v, want %v", deserialized.Value, original.Value)
 	}
 }
+
+func TestRecord_EncodeDecode(t *testing.T) {
+	record, err := encodeRecord("foo", "bar", false)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	record.stamp(42)
+
+	header, key, value, err := decodeRecord(record.buf)
+	if err != nil {
+		t.Fatalf("Failed to decode record: %v", err)
+	}
+	if header.crc != binary.BigEndian.Uint32(record.buf[0:4]) {
+		t.Errorf("CRC mismatch: got %v, want %v", header.crc, binary.BigEndian.Uint32(record.buf[0:4]))
+	}
+	if header.tstamp != 42 {
+		t.Errorf("Sequence number mismatch: got %v, want %v", header.tstamp, 42)
+	}
+	if header.ksz != uint32(len("foo")) {
+		t.Errorf("Key size mismatch: got %v, want %v", header.ksz, len("foo"))
+	}
+	if header.vsz != uint32(len("bar")) {
+		t.Errorf("Value size mismatch: got %v, want %v", header.vsz, len("bar"))
+	}
+	if string(key) != "foo" {
+		t.Errorf("Key mismatch: got %q, want %q", key, "foo")
+	}
+	if string(value) != "bar" {
+		t.Errorf("Value mismatch: got %q, want %q", value, "bar")
+	}
+}
+
+func TestRecord_BinaryLayout(t *testing.T) {
+	record, err := encodeRecord("foo", "bar", false)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	record.stamp(1)
+
+	data := record.buf
+	if len(data) != recordHeaderSize+len("foo")+len("bar") {
+		t.Errorf("Encoded size mismatch: got %d, want %d", len(data), recordHeaderSize+6)
+	}
+	if binary.BigEndian.Uint32(data[0:4]) != crc32.ChecksumIEEE(data[4:]) {
+		t.Errorf("CRC is not the first field of the record")
+	}
+	if binary.BigEndian.Uint64(data[4:12]) != 1 {
+		t.Errorf("Sequence number does not follow the CRC")
+	}
+	if string(data[recordHeaderSize:]) != "foobar" {
+		t.Errorf("Key and value not found after the header: got %q", data[recordHeaderSize:])
+	}
+}
+
+func TestRecord_Tombstone(t *testing.T) {
+	record, err := encodeRecord("foo", "", true)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	record.stamp(1)
+
+	header, key, value, err := decodeRecord(record.buf)
+	if err != nil {
+		t.Fatalf("Failed to decode record: %v", err)
+	}
+	if !header.isTombstone() {
+		t.Errorf("Tombstone flag lost in round trip")
+	}
+	if string(key) != "foo" {
+		t.Errorf("Key mismatch: got %q, want %q", key, "foo")
+	}
+	if len(value) != 0 {
+		t.Errorf("Expected a tombstone without value, got %q", value)
+	}
+}
+
+func TestBatchRecord(t *testing.T) {
+	put, err := encodeRecord("foo", "bar", false)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	put.stamp(1)
+	del, err := encodeRecord("baz", "", true)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	del.stamp(2)
+
+	data, err := encodeBatch([]*encodedRecord{put, del}, 2)
+	if err != nil {
+		t.Fatalf("Failed to encode batch: %v", err)
+	}
+	header := decodeRecordHeader(data)
+	if !header.isBatch() || header.isTombstone() {
+		t.Fatalf("Expected a batch header, got %+v", header)
+	}
+	if int64(len(data)) != recordHeaderSize+header.payloadSize() {
+		t.Errorf("Batch size mismatch: got %d, header says %d", len(data), recordHeaderSize+header.payloadSize())
+	}
+	if _, _, _, err := decodeRecord(data); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected decodeRecord to reject a batch, got %v", err)
+	}
+
+	records, err := decodeBatch(data[recordHeaderSize:])
+	if err != nil {
+		t.Fatalf("Failed to decode batch: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records in batch, got %d", len(records))
+	}
+	if string(records[0].key) != "foo" || records[0].offset != 0 || records[0].size != int64(len(put.buf)) {
+		t.Errorf("Unexpected first record %+v", records[0])
+	}
+	if string(records[1].key) != "baz" || !records[1].header.isTombstone() || records[1].offset != int64(len(put.buf)) {
+		t.Errorf("Unexpected second record %+v", records[1])
+	}
+
+	if _, err := decodeBatch(data[recordHeaderSize : len(data)-1]); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted for a batch cut short, got %v", err)
+	}
+}
+
+func TestExpiringRecord(t *testing.T) {
+	expiry := time.Now().Add(time.Minute).UnixNano()
+	record, err := encodeExpiringRecord("foo", "bar", expiry, false)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	record.stamp(1)
+	if len(record.buf) != recordHeaderSize+expirySize+len("foo")+len("bar") {
+		t.Errorf("Encoded size mismatch: got %d", len(record.buf))
+	}
+
+	header, key, value, err := decodeRecord(record.buf)
+	if err != nil {
+		t.Fatalf("Failed to decode record: %v", err)
+	}
+	if !header.expires || header.ksz != uint32(len("foo")) {
+		t.Errorf("Expected an expiring header with the plain key size, got %+v", header)
+	}
+	if string(key) != "foo" || string(value) != "bar" {
+		t.Errorf("Key and value mismatch: got %q, %q", key, value)
+	}
+	if got, _, _ := header.splitPayload(record.buf[recordHeaderSize:]); got != expiry {
+		t.Errorf("Expiry mismatch: got %d, want %d", got, expiry)
+	}
+
+	// Records without a TTL keep the original layout.
+	plain, err := encodeRecord("foo", "bar", false)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	plain.stamp(1)
+	if header := decodeRecordHeader(plain.buf); header.expires {
+		t.Errorf("Expected a record without TTL not to expire")
+	}
+}
+
+func TestLegacyGobFile(t *testing.T) {
+	originalOutput := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(originalOutput)
+
+	tmpDir := t.TempDir()
+
+	// Write a data file the way the engine did before the binary format.
+	var file bytes.Buffer
+	for _, kv := range [][2]string{{"hello", "world"}, {"foo", "bar"}, {"hello", "again"}} {
+		fe := &FileEntry{
+			Tstamp:  time.Now().Unix(),
+			Ksz:     uint32(len(kv[0])),
+			ValueSz: uint32(len(kv[1])),
+			Key:     kv[0],
+			Value:   kv[1],
+		}
+		fe.Crc = fe.legacyChecksum()
+		var payload bytes.Buffer
+		if err := gob.NewEncoder(&payload).Encode(fe); err != nil {
+			t.Fatalf("Gob encoding failed: %v", err)
+		}
+		lenBuf := make([]byte, 8)
+		binary.BigEndian.PutUint64(lenBuf, uint64(payload.Len()))
+		file.Write(lenBuf)
+		file.Write(payload.Bytes())
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "1000.data"), file.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write legacy file: %v", err)
+	}
+
+	be, err := NewBistcaskEngine(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer be.Close()
+	if err := be.BuildIndex(); err != nil {
+		t.Fatalf("BuildIndex Failed: '%v'", err)
+	}
+
+	check := func() {
+		for key, want := range map[string]string{"hello": "again", "foo": "bar"} {
+			val, err := be.Get(key)
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			if val != want {
+				t.Errorf("the value '%s' is not the same as expected '%s'", val, want)
+			}
+		}
+	}
+	check()
+
+	// Merging rewrites the legacy records in the binary format.
+	if err := be.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	check()
+}
+
+func TestRecord_ChecksumMismatch(t *testing.T) {
+	record, err := encodeRecord("foo", "bar", false)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	record.stamp(1)
+
+	// Flip a bit in the sequence number, the value and the size carrying the tombstone marker.
+	data := record.buf
+	for _, offset := range []int{4, len(data) - 1, 19} {
+		corrupted := bytes.Clone(data)
+		corrupted[offset] ^= 0x01
+		if _, _, _, err := decodeRecord(corrupted); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Expected ErrCorrupted for bit flip at offset %d, got %v", offset, err)
+		}
+	}
+}
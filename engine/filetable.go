@@ -0,0 +1,110 @@
+package engine
+
+// fileTable gives every data file the engine knows about a small numeric ID,
+// so keydir entries refer to their file with four bytes instead of a path,
+// and keeps track of how much of each file is dead. IDs are never reused
+// while the engine is open. Lookups may run under be.mu held for reading;
+// any change needs it exclusively.
+type fileTable struct {
+	paths map[uint32]string
+	ids   map[string]uint32
+	stats map[uint32]*fileStats
+	next  uint32
+}
+
+// fileStats tracks the space taken by the records of a data file. Whatever
+// the keydir does not point at, overwritten values, tombstones and expired
+// keys, is dead and only reclaimed by a merge.
+type fileStats struct {
+	// recordBytes is the size of every record in the file.
+	recordBytes int64
+
+	// liveBytes is the size of the records the keydir points at.
+	liveBytes int64
+}
+
+// deadBytes returns the size of the records no key points at.
+func (s fileStats) deadBytes() int64 {
+	return max(0, s.recordBytes-s.liveBytes)
+}
+
+// fragmentation returns the fraction of the file's records that are dead.
+func (s fileStats) fragmentation() float64 {
+	if s.recordBytes <= 0 {
+		return 0
+	}
+	return float64(s.deadBytes()) / float64(s.recordBytes)
+}
+
+func newFileTable() *fileTable {
+	return &fileTable{
+		paths: make(map[uint32]string),
+		ids:   make(map[string]uint32),
+		stats: make(map[uint32]*fileStats),
+	}
+}
+
+// add returns the ID of filePath, assigning a new one on first use.
+func (ft *fileTable) add(filePath string) uint32 {
+	if id, ok := ft.ids[filePath]; ok {
+		return id
+	}
+	id := ft.next
+	ft.next++
+	ft.ids[filePath] = id
+	ft.paths[id] = filePath
+	ft.stats[id] = &fileStats{}
+	return id
+}
+
+// lookup returns the ID of filePath if it has one.
+func (ft *fileTable) lookup(filePath string) (uint32, bool) {
+	id, ok := ft.ids[filePath]
+	return id, ok
+}
+
+// path returns the path of the file with the given ID.
+func (ft *fileTable) path(id uint32) string {
+	return ft.paths[id]
+}
+
+// addRecords records n bytes of records written to the file with the given ID.
+func (ft *fileTable) addRecords(id uint32, n int64) {
+	if s, ok := ft.stats[id]; ok {
+		s.recordBytes += n
+	}
+}
+
+// setRecords sets the size of the records of the file with the given ID.
+func (ft *fileTable) setRecords(id uint32, n int64) {
+	if s, ok := ft.stats[id]; ok {
+		s.recordBytes = n
+	}
+}
+
+// addLive adds n bytes, or removes them if n is negative, to the records the
+// keydir points at in the file with the given ID.
+func (ft *fileTable) addLive(id uint32, n int64) {
+	if s, ok := ft.stats[id]; ok {
+		s.liveBytes += n
+	}
+}
+
+// usage returns the stats of the file with the given ID.
+func (ft *fileTable) usage(id uint32) fileStats {
+	if s, ok := ft.stats[id]; ok {
+		return *s
+	}
+	return fileStats{}
+}
+
+// remove forgets files that no keydir entry or snapshot refers to any more.
+func (ft *fileTable) remove(filePaths ...string) {
+	for _, filePath := range filePaths {
+		if id, ok := ft.ids[filePath]; ok {
+			delete(ft.ids, filePath)
+			delete(ft.paths, id)
+			delete(ft.stats, id)
+		}
+	}
+}
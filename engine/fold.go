@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+)
+
+// Keys returns every live key in the store in ascending order.
+func (be *BitcaskEngine) Keys() ([]string, error) {
+	be.mu.RLock()
+	defer be.mu.RUnlock()
+
+	if be.closed {
+		return nil, ErrClosed
+	}
+	keys := make([]string, 0, be.keydir.Len())
+	be.keydir.Range("", "", false, skipExpired(func(key string, _ KeyDir) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	return keys, nil
+}
+
+// Len returns the number of live keys. A closed engine holds none. Keys that
+// expired since the last sweep are still counted.
+func (be *BitcaskEngine) Len() int {
+	be.mu.RLock()
+	defer be.mu.RUnlock()
+
+	if be.closed {
+		return 0
+	}
+	return be.keydir.Len()
+}
+
+// Has reports whether key is in the store without reading its value. A closed
+// engine holds no keys.
+func (be *BitcaskEngine) Has(key string) bool {
+	be.mu.RLock()
+	defer be.mu.RUnlock()
+
+	if be.closed {
+		return false
+	}
+	record, ok := be.keydir.Get(key)
+	return ok && !record.expiredAt(time.Now().UnixNano())
+}
+
+// Fold calls fn for every live key and its value in ascending key order. It
+// iterates over the store as it was when Fold was called: writes made while
+// it runs, including by fn itself, are not seen, and a concurrent Merge does
+// not disturb it. Fold stops at the first error returned by fn and returns it.
+func (be *BitcaskEngine) Fold(fn func(key, value string) error) error {
+	snap, err := be.newSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.release()
+
+	snap.keydir.Range("", "", false, skipExpired(func(key string, record KeyDir) bool {
+		var value []byte
+		value, err = be.readRecord(record)
+		if err != nil {
+			err = fmt.Errorf("unable to read value: %w", err)
+			return false
+		}
+		err = fn(key, string(value))
+		return err == nil
+	}))
+	return err
+}
@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Hint files sit next to immutable data files and hold everything needed to
+// rebuild the keydir without reading values. A hint file starts with
+//
+//	magic (4) | version (4) | data file size (8)
+//
+// and the recorded data file size lets a stale hint be told apart from one
+// matching the data file. Every entry is laid out as
+//
+//	crc (4) | tstamp (8) | flags (1) | ksz (4) | record size (8) | record pos (8) | key
+//
+// with the CRC covering everything after itself. From version 2 on, an entry
+// flagged with hintFlagExpiry has the record's expiry (8) between the header
+// and the key. Version 1 files never set the flag and are read the same way.
+// From version 3 on, tstamp holds the record's sequence number; older
+// versions store Unix seconds, which are converted when read.
+const (
+	hintMagic             = "BCSH"
+	hintVersion    uint32 = 3
+	hintSuffix            = ".hint"
+	hintTempSuffix        = ".hint.tmp"
+
+	hintFileHeaderSize  = 16
+	hintEntryHeaderSize = 33
+
+	hintFlagTombstone byte = 1 << 0
+	hintFlagExpiry    byte = 1 << 1
+)
+
+var errStaleHint = errors.New("hint file does not match its data file")
+
+type hintEntry struct {
+	key         string
+	tstamp      int64
+	expiry      int64
+	isTombstone bool
+	recordSize  uint64
+	recordPos   int64
+}
+
+func hintPath(dataFilePath string) string {
+	return strings.TrimSuffix(dataFilePath, ".data") + hintSuffix
+}
+
+// appendHintEntry encodes entry onto buf.
+func appendHintEntry(buf []byte, entry hintEntry) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, hintEntryHeaderSize)...)
+	header := buf[start:]
+
+	var flags byte
+	if entry.isTombstone {
+		flags |= hintFlagTombstone
+	}
+	if entry.expiry != 0 {
+		flags |= hintFlagExpiry
+	}
+	binary.BigEndian.PutUint64(header[4:12], uint64(entry.tstamp))
+	header[12] = flags
+	binary.BigEndian.PutUint32(header[13:17], uint32(len(entry.key)))
+	binary.BigEndian.PutUint64(header[17:25], entry.recordSize)
+	binary.BigEndian.PutUint64(header[25:33], uint64(entry.recordPos))
+	if entry.expiry != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(entry.expiry))
+	}
+	buf = append(buf, entry.key...)
+
+	binary.BigEndian.PutUint32(buf[start:start+4], crc32.ChecksumIEEE(buf[start+4:]))
+	return buf
+}
+
+// writeHintFile atomically writes the encoded entries as the hint file of
+// dataFilePath, which must be dataSize bytes long.
+func writeHintFile(dataFilePath string, dataSize int64, entries []byte) error {
+	header := make([]byte, hintFileHeaderSize)
+	copy(header, hintMagic)
+	binary.BigEndian.PutUint32(header[4:8], hintVersion)
+	binary.BigEndian.PutUint64(header[8:16], uint64(dataSize))
+
+	tempPath := strings.TrimSuffix(dataFilePath, ".data") + hintTempSuffix
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create hint file '%s': %w", tempPath, err)
+	}
+	_, err = file.Write(header)
+	if err == nil {
+		_, err = file.Write(entries)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, hintPath(dataFilePath))
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(dataFilePath))
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("unable to write hint file for '%s': %w", dataFilePath, err)
+	}
+	return nil
+}
+
+// readHintFile returns every entry of the hint file belonging to
+// dataFilePath. It fails without returning partial results if the hint is
+// missing, stale or corrupted.
+func readHintFile(dataFilePath string) ([]hintEntry, error) {
+	dataInfo, err := os.Stat(dataFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat data file '%s': %w", dataFilePath, err)
+	}
+	buf, err := os.ReadFile(hintPath(dataFilePath))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < hintFileHeaderSize || string(buf[:len(hintMagic)]) != hintMagic {
+		return nil, fmt.Errorf("%w: missing hint file header", ErrCorrupted)
+	}
+	version := binary.BigEndian.Uint32(buf[4:8])
+	if version == 0 || version > hintVersion {
+		return nil, fmt.Errorf("unsupported hint file version %d", version)
+	}
+	if dataSize := int64(binary.BigEndian.Uint64(buf[8:16])); dataSize != dataInfo.Size() {
+		return nil, fmt.Errorf("%w: hint covers %d bytes, data file has %d", errStaleHint, dataSize, dataInfo.Size())
+	}
+
+	var entries []hintEntry
+	offset := hintFileHeaderSize
+	for offset < len(buf) {
+		if len(buf)-offset < hintEntryHeaderSize {
+			return nil, fmt.Errorf("%w: truncated hint entry at offset %d", ErrCorrupted, offset)
+		}
+		header := buf[offset : offset+hintEntryHeaderSize]
+		keyOffset := offset + hintEntryHeaderSize
+		if header[12]&hintFlagExpiry != 0 {
+			keyOffset += expirySize
+		}
+		ksz := int(binary.BigEndian.Uint32(header[13:17]))
+		end := keyOffset + ksz
+		if ksz > len(buf) || end > len(buf) {
+			return nil, fmt.Errorf("%w: hint entry at offset %d runs past the end of the file", ErrCorrupted, offset)
+		}
+		if crc := crc32.ChecksumIEEE(buf[offset+4 : end]); crc != binary.BigEndian.Uint32(header[0:4]) {
+			return nil, fmt.Errorf("%w: checksum mismatch in hint entry at offset %d", ErrCorrupted, offset)
+		}
+
+		if recordSize := binary.BigEndian.Uint64(header[17:25]); recordSize > math.MaxUint32 {
+			return nil, fmt.Errorf("%w: hint entry at offset %d has a record size of %d bytes", ErrCorrupted, offset, recordSize)
+		}
+		entry := hintEntry{
+			key:         string(buf[keyOffset:end]),
+			tstamp:      int64(binary.BigEndian.Uint64(header[4:12])),
+			isTombstone: header[12]&hintFlagTombstone != 0,
+			recordSize:  binary.BigEndian.Uint64(header[17:25]),
+			recordPos:   int64(binary.BigEndian.Uint64(header[25:33])),
+		}
+		if header[12]&hintFlagExpiry != 0 {
+			entry.expiry = int64(binary.BigEndian.Uint64(buf[offset+hintEntryHeaderSize : keyOffset]))
+		}
+		if version < 3 {
+			entry.tstamp = legacySequence(entry.tstamp)
+		}
+		entries = append(entries, entry)
+		offset = end
+	}
+	return entries, nil
+}
+
+// processHintFile collects the records of a data file into scan from its
+// hint file. It reports false when the hint is missing or unusable, in which
+// case the data file itself has to be scanned.
+func (be *BitcaskEngine) processHintFile(scan *fileScan, filePath string) bool {
+	entries, err := readHintFile(filePath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			be.logger.Warn("Ignoring hint file", "file", filePath, "error", err)
+		}
+		return false
+	}
+
+	be.logger.Debug("Processing hint file", "file", filePath)
+	for _, entry := range entries {
+		scan.add(entry.key, entry.tstamp, entry.expiry, entry.isTombstone, entry.recordPos, uint32(entry.recordSize))
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package engine
+
+// Index maps every live key to the location of its newest record. The engine
+// keeps it in key order so ranges of keys can be scanned.
+//
+// Implementations need not be safe for concurrent use: the engine serializes
+// mutations and Clone, and only calls Get, Len and Range concurrently with
+// each other.
+type Index interface {
+	// Get returns the entry of key, if there is one.
+	Get(key string) (KeyDir, bool)
+
+	// Set adds key or replaces its entry.
+	Set(key string, entry KeyDir)
+
+	// Delete removes key if it is present.
+	Delete(key string)
+
+	// Len returns the number of keys.
+	Len() int
+
+	// Range calls fn for every key in [start, end) in ascending order, or in
+	// descending order if reverse is set, until fn returns false. An empty
+	// end leaves the range unbounded above.
+	Range(start, end string, reverse bool, fn func(key string, entry KeyDir) bool)
+
+	// Clone returns an independent copy of the index. Changes made to either
+	// copy afterwards are not seen by the other.
+	Clone() Index
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or "" if there is none, which Range treats as unbounded.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
@@ -1,8 +1,30 @@
 package engine
 
+// KeyDir locates the newest record of a key. It is a fixed-size value of 32
+// bytes held directly in the index, without a pointer of its own. The key,
+// its string header and the B-tree nodes come on top: BenchmarkKeydirMemory
+// measures about 118 bytes of heap per 14-byte key in total.
 type KeyDir struct {
-	FileID   string
-	ValueSz  uint64
+	// FileID identifies the data file holding the record through the
+	// engine's file table.
+	FileID uint32
+
+	// ValueSz is the size of the whole record, header included.
+	ValueSz uint32
+
+	// ValuePos is the offset of the record in its data file.
 	ValuePos int64
-	Tstamp   int64
+
+	// Tstamp is the sequence number of the record, unique to it and higher
+	// than that of every record written before it.
+	Tstamp int64
+
+	// Expiry is when the key expires, in Unix nanoseconds, or zero if it
+	// never does.
+	Expiry int64
+}
+
+// expiredAt reports whether the key has expired by now, in Unix nanoseconds.
+func (kd KeyDir) expiredAt(now int64) bool {
+	return kd.Expiry != 0 && kd.Expiry <= now
 }
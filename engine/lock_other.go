@@ -0,0 +1,22 @@
+//go:build !unix
+
+package engine
+
+import (
+	"fmt"
+	"os"
+)
+
+// acquireLock only creates the lock file on platforms without flock, so the
+// store is not protected against concurrent writers there.
+func acquireLock(path string, shared bool) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock file '%s': %w", path, err)
+	}
+	return file, nil
+}
+
+func releaseLock(file *os.File) error {
+	return file.Close()
+}
@@ -0,0 +1,41 @@
+//go:build unix
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// acquireLock takes a non-blocking flock on the file at path, creating it if
+// needed. Any number of shared holders may coexist, an exclusive holder
+// excludes everyone else.
+func acquireLock(path string, shared bool) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock file '%s': %w", path, err)
+	}
+
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrDatabaseLocked
+		}
+		return nil, fmt.Errorf("unable to lock '%s': %w", path, err)
+	}
+	return file, nil
+}
+
+func releaseLock(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,329 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const mergeTempSuffix = ".merge"
+
+type mergeRecord struct {
+	key      string
+	oldEntry KeyDir
+	newEntry KeyDir
+	outIndex int
+}
+
+// Merge compacts every immutable data file into new files that only hold the
+// records the keydir still points at, so overwritten values, tombstones and
+// expired keys are dropped. Files written in the legacy gob format are upgraded along the way.
+// The keydir is switched over to the new files in one step before the old
+// files are removed. The active file is never touched, which keeps Put and
+// Delete working while the merge runs.
+//
+// While snapshots taken by Fold or an Iterator are open, the old files are
+// kept until the last of them is released, since the snapshots may still
+// read from them.
+func (be *BitcaskEngine) Merge() error {
+	if err := be.checkWritable(); err != nil {
+		return err
+	}
+	be.mergeMu.Lock()
+	defer be.mergeMu.Unlock()
+
+	// Holding the lock keeps rollovers out, so no new active file can sneak into
+	// the inputs and no hint file is half-written while leftovers are removed.
+	be.mu.RLock()
+	if be.closed {
+		be.mu.RUnlock()
+		return ErrClosed
+	}
+	if err := removeMergeLeftovers(be.ActiveDir); err != nil {
+		be.mu.RUnlock()
+		return err
+	}
+	activePath := be.ActiveFile.Name()
+	dataFiles, err := be.listDataFiles()
+	if err != nil {
+		be.mu.RUnlock()
+		be.logger.Error("Unable to list data files for merge", "error", err)
+		return err
+	}
+
+	// Keydir entries refer to the inputs by FileID.
+	inputOrder := make(map[uint32]int)
+	inputPaths := make(map[uint32]string)
+	var inputs []string
+	obsolete := make(map[string]bool, len(be.obsoleteFiles))
+	for _, filePath := range be.obsoleteFiles {
+		obsolete[filePath] = true
+	}
+	for _, filePath := range dataFiles {
+		// Records waiting for their fsync are not in the keydir yet, so
+		// neither the file they start in nor any later one is merged.
+		if filePath == be.hiddenFrom {
+			break
+		}
+		// Files kept for open snapshots are already merged.
+		if filePath == activePath || obsolete[filePath] {
+			continue
+		}
+		if fileID, ok := be.files.lookup(filePath); ok {
+			inputOrder[fileID] = len(inputs)
+			inputPaths[fileID] = filePath
+		}
+		inputs = append(inputs, filePath)
+	}
+
+	var live, expired []*mergeRecord
+	now := time.Now().UnixNano()
+	be.keydir.Range("", "", false, func(key string, record KeyDir) bool {
+		if _, ok := inputOrder[record.FileID]; ok {
+			if record.expiredAt(now) {
+				expired = append(expired, &mergeRecord{key: key, oldEntry: record})
+			} else {
+				live = append(live, &mergeRecord{key: key, oldEntry: record})
+			}
+		}
+		return true
+	})
+	be.mu.RUnlock()
+
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	// Merged files are numbered just below the oldest input, so on rebuild they
+	// are replayed before the active file and any file created after it.
+	firstID, err := parseFileID(inputs[0])
+	if err != nil {
+		return fmt.Errorf("unable to merge non-numeric data file '%s': %w", inputs[0], err)
+	}
+
+	// Copy records in on-disk order to keep the reads sequential.
+	sort.Slice(live, func(i, j int) bool {
+		fi, fj := inputOrder[live[i].oldEntry.FileID], inputOrder[live[j].oldEntry.FileID]
+		if fi != fj {
+			return fi < fj
+		}
+		return live[i].oldEntry.ValuePos < live[j].oldEntry.ValuePos
+	})
+
+	outputs, err := be.writeMergeFiles(live, inputPaths)
+	if err != nil {
+		for _, output := range outputs {
+			os.Remove(output.tempPath)
+		}
+		return err
+	}
+
+	finalPaths := make([]string, len(outputs))
+	for i, output := range outputs {
+		finalPaths[i] = filepath.Join(be.ActiveDir, fmt.Sprintf("%d.data", firstID-int64(len(outputs)-i)))
+		if err := os.Rename(output.tempPath, finalPaths[i]); err != nil {
+			be.logger.Error("Unable to rename merge file", "file", output.tempPath, "error", err)
+			return fmt.Errorf("unable to rename merge file '%s': %w", output.tempPath, err)
+		}
+		if err := writeHintFile(finalPaths[i], output.size, output.hints); err != nil {
+			be.logger.Warn("Unable to write hint file for merged file", "file", finalPaths[i], "error", err)
+		}
+	}
+	// The merged files must be durable before the inputs can go.
+	if err := syncDir(be.ActiveDir); err != nil {
+		be.logger.Error("Unable to sync directory after merge", "error", err)
+		return err
+	}
+
+	be.mu.Lock()
+	finalIDs := make([]uint32, len(finalPaths))
+	for i, finalPath := range finalPaths {
+		finalIDs[i] = be.files.add(finalPath)
+		be.files.setRecords(finalIDs[i], outputs[i].size-fileHeaderSize)
+	}
+	for _, rec := range live {
+		rec.newEntry.FileID = finalIDs[rec.outIndex]
+		// Only switch keys that were not overwritten or deleted while we were copying.
+		if current, ok := be.keydir.Get(rec.key); ok && current == rec.oldEntry {
+			be.setKey(rec.key, rec.newEntry)
+		}
+	}
+	for _, rec := range expired {
+		if current, ok := be.keydir.Get(rec.key); ok && current == rec.oldEntry {
+			be.deleteKey(rec.key)
+		}
+	}
+	// Nothing points at the inputs any more, and no Get can be reading them
+	// while we hold the lock.
+	be.readers.evict(inputs...)
+	if be.snapshots > 0 {
+		be.obsoleteFiles = append(be.obsoleteFiles, inputs...)
+		be.mu.Unlock()
+		be.logger.Info("Merged data files, keeping the old ones for open snapshots", "inputs", len(inputs), "outputs", len(finalPaths))
+		return nil
+	}
+	be.files.remove(inputs...)
+	be.mu.Unlock()
+
+	if err := be.removeDataFiles(inputs); err != nil {
+		return err
+	}
+
+	be.logger.Info("Merged data files", "inputs", len(inputs), "outputs", len(finalPaths))
+	return nil
+}
+
+// removeDataFiles deletes merged data files along with their hint files.
+func (be *BitcaskEngine) removeDataFiles(filePaths []string) error {
+	for _, filePath := range filePaths {
+		// Drop the hint first so a crash never leaves one behind without its data file.
+		if err := os.Remove(hintPath(filePath)); err != nil && !os.IsNotExist(err) {
+			be.logger.Error("Unable to remove hint file of merged file", "file", filePath, "error", err)
+			return fmt.Errorf("unable to remove hint file of merged file '%s': %w", filePath, err)
+		}
+		if err := os.Remove(filePath); err != nil {
+			be.logger.Error("Unable to remove merged file", "file", filePath, "error", err)
+			return fmt.Errorf("unable to remove merged file '%s': %w", filePath, err)
+		}
+	}
+
+	if err := syncDir(be.ActiveDir); err != nil {
+		be.logger.Error("Unable to sync directory after merge", "error", err)
+		return err
+	}
+	return nil
+}
+
+type mergeOutput struct {
+	tempPath string
+	size     int64
+	hints    []byte
+}
+
+// writeMergeFiles re-encodes every live record into temporary merge files in
+// the current format, rolling over at MaxFileSize, and collects the hint
+// entries of each. inputPaths maps the FileID of every input to its path.
+// FileID of each newEntry is filled in by the caller once the final file
+// names are known.
+func (be *BitcaskEngine) writeMergeFiles(live []*mergeRecord, inputPaths map[uint32]string) ([]*mergeOutput, error) {
+	var outputs []*mergeOutput
+	var current *mergeOutput
+	var out *os.File
+
+	sources := make(map[uint32]*readerFile)
+	defer func() {
+		for _, src := range sources {
+			src.close()
+		}
+	}()
+
+	closeOutput := func() error {
+		if out == nil {
+			return nil
+		}
+		err := out.Sync()
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		out = nil
+		if err != nil {
+			return fmt.Errorf("unable to finish merge file: %w", err)
+		}
+		return nil
+	}
+
+	for _, rec := range live {
+		src, ok := sources[rec.oldEntry.FileID]
+		if !ok {
+			file, err := os.Open(inputPaths[rec.oldEntry.FileID])
+			if err != nil {
+				closeOutput()
+				return outputs, fmt.Errorf("unable to open file '%s' for merge: %w", inputPaths[rec.oldEntry.FileID], err)
+			}
+			format, err := detectFileFormat(file)
+			if err != nil {
+				file.Close()
+				closeOutput()
+				return outputs, err
+			}
+			src = &readerFile{file: file, format: format}
+			sources[rec.oldEntry.FileID] = src
+		}
+
+		value, _, err := be.readValue(src, rec.oldEntry)
+		if err != nil {
+			closeOutput()
+			return outputs, fmt.Errorf("unable to read record at offset '%d' of '%s': %w", rec.oldEntry.ValuePos, inputPaths[rec.oldEntry.FileID], err)
+		}
+		record, err := encodeExpiringRecord(rec.key, value, rec.oldEntry.Expiry, false)
+		if err != nil {
+			closeOutput()
+			return outputs, fmt.Errorf("unable to encode record at offset '%d' of '%s': %w", rec.oldEntry.ValuePos, inputPaths[rec.oldEntry.FileID], err)
+		}
+		record.stamp(rec.oldEntry.Tstamp)
+
+		buf := record.buf
+		if out == nil || (current.size > fileHeaderSize && current.size+int64(len(buf)) > be.MaxFileSize) {
+			if err := closeOutput(); err != nil {
+				return outputs, err
+			}
+			current = &mergeOutput{
+				tempPath: filepath.Join(be.ActiveDir, fmt.Sprintf("%d%s", len(outputs), mergeTempSuffix)),
+				size:     fileHeaderSize,
+			}
+			out, err = os.OpenFile(current.tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				return outputs, fmt.Errorf("unable to create merge file '%s': %w", current.tempPath, err)
+			}
+			outputs = append(outputs, current)
+			if _, err := out.Write(encodeFileHeader(currentFormat)); err != nil {
+				closeOutput()
+				return outputs, fmt.Errorf("unable to write merge file header: %w", err)
+			}
+		}
+
+		if _, err := out.Write(buf); err != nil {
+			closeOutput()
+			return outputs, fmt.Errorf("unable to write merge file: %w", err)
+		}
+
+		rec.outIndex = len(outputs) - 1
+		rec.newEntry = KeyDir{
+			ValueSz:  uint32(len(buf)),
+			ValuePos: current.size,
+			Tstamp:   rec.oldEntry.Tstamp,
+			Expiry:   rec.oldEntry.Expiry,
+		}
+		current.hints = appendHintEntry(current.hints, hintEntry{
+			key:        rec.key,
+			tstamp:     rec.oldEntry.Tstamp,
+			expiry:     rec.oldEntry.Expiry,
+			recordSize: uint64(rec.newEntry.ValueSz),
+			recordPos:  rec.newEntry.ValuePos,
+		})
+		current.size += int64(len(buf))
+	}
+
+	return outputs, closeOutput()
+}
+
+// removeMergeLeftovers deletes temporary files left behind by an interrupted
+// merge or hint file write.
+func removeMergeLeftovers(directory string) error {
+	directoryEntries, err := os.ReadDir(directory)
+	if err != nil {
+		return fmt.Errorf("unable to read directory '%s': %w", directory, err)
+	}
+	for _, entry := range directoryEntries {
+		if entry.IsDir() || !(strings.HasSuffix(entry.Name(), mergeTempSuffix) || strings.HasSuffix(entry.Name(), hintTempSuffix)) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(directory, entry.Name())); err != nil {
+			return fmt.Errorf("unable to remove stale temporary file '%s': %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package engine
+
+import (
+	"errors"
+	"os"
+)
+
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+// mmapFile always fails on platforms without mmap, so reads fall back to ReadAt.
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"log/slog"
+	"time"
+)
+
+// DefaultMaxFileSize is the size at which the active file is rolled over
+// unless Options.MaxFileSize says otherwise.
+const DefaultMaxFileSize = 1 * 1024 * 1024 // 1MB
+
+// SyncPolicy controls when appended records are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing to the operating system. A Put acknowledged
+	// shortly before a power failure may be lost, and reads see writes as
+	// soon as they are acknowledged.
+	SyncNever SyncPolicy = iota
+	// SyncAlways fsyncs the active file after every write. Reads only see a
+	// write once it is durable, and a write whose fsync fails is never seen,
+	// though it may still turn up after a restart.
+	SyncAlways
+	// SyncEveryN fsyncs the active file after every Options.SyncEveryN
+	// writes. Reads see the writes in between before they are durable.
+	SyncEveryN
+	// SyncInterval fsyncs the active file from a background goroutine every
+	// Options.SyncInterval. Reads see writes before they are durable.
+	SyncInterval
+)
+
+// DefaultSyncInterval is used by SyncInterval when Options.SyncInterval is zero.
+const DefaultSyncInterval = time.Second
+
+// DefaultExpirySweepInterval is used when Options.ExpirySweepInterval is zero.
+const DefaultExpirySweepInterval = time.Minute
+
+// DefaultMergeCheckInterval is a reasonable Options.MergeCheckInterval for
+// stores that want automatic merges.
+const DefaultMergeCheckInterval = 3 * time.Minute
+
+// DefaultMergeFragmentation is used when Options.MergeFragmentation is zero.
+const DefaultMergeFragmentation = 0.6
+
+// DefaultMergeDeadBytes is used when Options.MergeDeadBytes is zero.
+const DefaultMergeDeadBytes = 512 * 1024 * 1024 // 512MB
+
+// Options configures an engine opened with Open. The zero value is usable
+// and equivalent to DefaultOptions.
+type Options struct {
+	// MaxFileSize is the size in bytes at which the active file is rolled
+	// over. Zero means DefaultMaxFileSize.
+	MaxFileSize int64
+
+	// SyncPolicy controls when writes are flushed to disk. Whatever the
+	// policy, Sync flushes on demand and files are flushed when they are
+	// rolled over or closed, unless the policy is SyncNever.
+	SyncPolicy SyncPolicy
+
+	// SyncEveryN is the number of writes between fsyncs under SyncEveryN.
+	// Zero or less means every write.
+	SyncEveryN int
+
+	// SyncInterval is the time between fsyncs under SyncInterval. Zero means
+	// DefaultSyncInterval.
+	SyncInterval time.Duration
+
+	// ReadOnly opens the store without an active file. Put, Delete and Merge
+	// fail with ErrReadOnly and recovery never modifies files on disk.
+	ReadOnly bool
+
+	// Repair truncates data files at corrupted records found while opening
+	// instead of failing. See BitcaskEngine.Repair.
+	Repair bool
+
+	// Mmap maps immutable data files into memory, so Get slices records
+	// straight out of the mapping instead of issuing a ReadAt per lookup. The
+	// active file is always read with ReadAt.
+	Mmap bool
+
+	// NewIndex creates the index holding the keydir. Nil means
+	// NewBTreeIndex.
+	NewIndex func() Index
+
+	// Logger receives the engine's log output. Nil means slog.Default().
+	// Reads and writes only log at debug level, or at error level when
+	// they fail for a reason other than the caller's input, so they stay
+	// quiet under the default Info level.
+	Logger *slog.Logger
+
+	// LogKeys includes keys in log output. By default they are redacted.
+	// Values are never logged.
+	LogKeys bool
+
+	// IndexWorkers is the number of data files read at once while rebuilding
+	// the keydir. The result is the same whatever the number. Zero means
+	// runtime.GOMAXPROCS(0).
+	IndexWorkers int
+
+	// ExpirySweepInterval is the time between sweeps removing keys whose TTL
+	// has passed from the keydir. Expired keys are hidden from reads either
+	// way; sweeping frees their memory. Zero means
+	// DefaultExpirySweepInterval and a negative value disables sweeping.
+	ExpirySweepInterval time.Duration
+
+	// MergeCheckInterval is the time between checks of whether any immutable
+	// data file is fragmented enough to merge. Automatic merging is off
+	// unless it is positive, so merges and the file removals they bring only
+	// happen for stores that opt in. Merge can always be called directly.
+	MergeCheckInterval time.Duration
+
+	// MergeFragmentation starts a merge once the dead records, overwritten,
+	// deleted or expired, make up at least this fraction of the records of an
+	// immutable data file. Zero means DefaultMergeFragmentation and a
+	// negative value disables the trigger.
+	MergeFragmentation float64
+
+	// MergeDeadBytes starts a merge once an immutable data file holds at
+	// least this many bytes of dead records. Zero means DefaultMergeDeadBytes
+	// and a negative value disables the trigger.
+	MergeDeadBytes int64
+
+	// MergeWindow restricts automatic merges to certain hours of the day.
+	// Nil allows them at any time. Open rejects hours outside 0 to 23.
+	MergeWindow *MergeWindow
+}
+
+// DefaultOptions returns the options used by NewBistcaskEngine.
+func DefaultOptions() Options {
+	return Options{
+		MaxFileSize: DefaultMaxFileSize,
+		SyncPolicy:  SyncNever,
+	}
+}
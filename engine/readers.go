@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// readerFile is an open read-only handle on a data file together with the
+// record format it was written in. data holds the mapping of an immutable
+// file when reads go through mmap.
+type readerFile struct {
+	file   *os.File
+	format uint32
+	data   []byte
+}
+
+func (rf *readerFile) close() error {
+	var err error
+	if rf.data != nil {
+		err = munmapFile(rf.data)
+		rf.data = nil
+	}
+	if closeErr := rf.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readerCache keeps one read-only handle per data file, so Get does not have
+// to open and close the file on every lookup. ReadAt is safe for concurrent
+// use, so a single handle is shared by every reader.
+//
+// With mmap set, immutable files are mapped into memory as well and records
+// are sliced straight out of the mapping. Files that cannot be mapped are
+// read with ReadAt instead.
+//
+// Handles and mappings are only released while be.mu is held exclusively,
+// which guarantees no Get is reading through them at that moment.
+type readerCache struct {
+	mu    sync.RWMutex
+	files map[string]*readerFile
+	mmap  bool
+}
+
+func newReaderCache(mmap bool) *readerCache {
+	return &readerCache{files: make(map[string]*readerFile), mmap: mmap}
+}
+
+// get returns the cached handle of filePath, opening it on first use. A file
+// is only mapped if it is immutable, since appends would run past the end
+// of the mapping.
+func (rc *readerCache) get(filePath string, immutable bool) (*readerFile, error) {
+	rc.mu.RLock()
+	rf, ok := rc.files[filePath]
+	rc.mu.RUnlock()
+	if ok {
+		return rf, nil
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rf, ok := rc.files[filePath]; ok {
+		return rf, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file '%s': %w", filePath, err)
+	}
+	format, err := detectFileFormat(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	rf = &readerFile{file: file, format: format}
+	if rc.mmap && immutable {
+		if fileInfo, err := file.Stat(); err == nil && fileInfo.Size() > 0 {
+			if data, err := mmapFile(file, fileInfo.Size()); err == nil {
+				rf.data = data
+			}
+		}
+	}
+	rc.files[filePath] = rf
+	return rf, nil
+}
+
+// evict closes the handles of the given files, typically because merge is
+// about to remove them or they just became immutable and can now be mapped.
+// The caller must hold be.mu exclusively.
+func (rc *readerCache) evict(filePaths ...string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, filePath := range filePaths {
+		if rf, ok := rc.files[filePath]; ok {
+			rf.close()
+			delete(rc.files, filePath)
+		}
+	}
+}
+
+// closeAll closes every cached handle. The caller must hold be.mu exclusively.
+func (rc *readerCache) closeAll() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var err error
+	for filePath, rf := range rc.files {
+		if closeErr := rf.close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("unable to close reader of '%s': %w", filePath, closeErr)
+		}
+		delete(rc.files, filePath)
+	}
+	return err
+}
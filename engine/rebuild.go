@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// scannedRecord is a record found in a data file or its hint file while
+// rebuilding the index.
+type scannedRecord struct {
+	key               string
+	tstamp            int64
+	expiry            int64
+	isTombstone       bool
+	recordStartOffset int64
+	recordTotalSize   uint32
+}
+
+// fileScan collects the records of one data file, so files can be read in
+// parallel while their records are applied to the keydir in file order.
+type fileScan struct {
+	fileID  uint32
+	records []scannedRecord
+	err     error
+}
+
+func (s *fileScan) add(key string, tstamp, expiry int64, isTombstone bool, recordStartOffset int64, recordTotalSize uint32) {
+	s.records = append(s.records, scannedRecord{
+		key:               key,
+		tstamp:            tstamp,
+		expiry:            expiry,
+		isTombstone:       isTombstone,
+		recordStartOffset: recordStartOffset,
+		recordTotalSize:   recordTotalSize,
+	})
+}
+
+// scanDataFiles indexes dataFiles, oldest first, reading up to
+// be.indexWorkers of them at once from their hint files or their records.
+// Every file is applied to the keydir only after all older ones, exactly as
+// if they had been read one at a time, so the keydir does not depend on the
+// number of workers. tailFile is the one file whose torn tail may be
+// truncated. Repair ignores hint files, since they would hide corruption in
+// the records. The caller must hold be.mu exclusively.
+func (be *BitcaskEngine) scanDataFiles(dataFiles []string, tailFile string) error {
+	if len(dataFiles) == 0 {
+		return nil
+	}
+	workers := max(1, min(be.indexWorkers, len(dataFiles)))
+
+	// IDs are handed out up front, since the file table is not safe for
+	// concurrent use.
+	scans := make([]fileScan, len(dataFiles))
+	for i, filePath := range dataFiles {
+		scans[i].fileID = be.files.add(filePath)
+	}
+
+	// done[i] is closed once file i has been read. pending limits how far the
+	// workers run ahead of the oldest file not yet applied, and with it the
+	// records held in memory.
+	done := make([]chan struct{}, len(dataFiles))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	jobs := make(chan int)
+	pending := make(chan struct{}, 2*workers)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	go func() {
+		defer close(jobs)
+		for i := range dataFiles {
+			select {
+			case pending <- struct{}{}:
+			case <-stop:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				scan := &scans[i]
+				if be.Repair || !be.processHintFile(scan, dataFiles[i]) {
+					scan.err = be.processOldFile(scan, dataFiles[i], dataFiles[i] == tailFile)
+				}
+				close(done[i])
+			}
+		}()
+	}
+
+	for i, filePath := range dataFiles {
+		<-done[i]
+		scan := &scans[i]
+		if scan.err != nil {
+			be.logger.Error("Unable to process data file", "file", filePath, "error", scan.err)
+			return fmt.Errorf("failed processing file '%s': %w", filepath.Base(filePath), scan.err)
+		}
+		for _, record := range scan.records {
+			be.indexRecord(scan.fileID, record.key, record.tstamp, record.expiry, record.isTombstone, record.recordStartOffset, record.recordTotalSize)
+		}
+		scan.records = nil
+		<-pending
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package engine
+
+import "iter"
+
+// Iterator walks a range of keys in order, as of the moment it was created.
+// It must be closed once done with, since merged data files are kept on disk
+// for as long as it is open.
+//
+//	it, err := be.PrefixScan("2024-06-", false)
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	return it.Err()
+type Iterator struct {
+	snap  *snapshot
+	next  func() (string, KeyDir, bool)
+	stop  func()
+	key   string
+	value []byte
+	err   error
+	done  bool
+}
+
+// Scan returns an iterator over the keys in [start, end), in ascending order
+// or in descending order if reverse is set. An empty end leaves the range
+// unbounded above.
+func (be *BitcaskEngine) Scan(start, end string, reverse bool) (*Iterator, error) {
+	snap, err := be.newSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	next, stop := iter.Pull2(func(yield func(string, KeyDir) bool) {
+		snap.keydir.Range(start, end, reverse, skipExpired(yield))
+	})
+	return &Iterator{snap: snap, next: next, stop: stop}, nil
+}
+
+// PrefixScan returns an iterator over the keys starting with prefix, in
+// ascending order or in descending order if reverse is set.
+func (be *BitcaskEngine) PrefixScan(prefix string, reverse bool) (*Iterator, error) {
+	return be.Scan(prefix, prefixEnd(prefix), reverse)
+}
+
+// Next advances to the next key and reads its value. It returns false once
+// the range is exhausted or reading fails, see Err.
+func (it *Iterator) Next() bool {
+	if it.done {
+		return false
+	}
+	key, record, ok := it.next()
+	if !ok {
+		it.done = true
+		return false
+	}
+	value, err := it.snap.be.readRecord(record)
+	if err != nil {
+		it.err = err
+		it.done = true
+		return false
+	}
+	it.key, it.value = key, value
+	return true
+}
+
+// Key returns the key Next stopped at.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the value of the key Next stopped at.
+func (it *Iterator) Value() string {
+	return string(it.value)
+}
+
+// ValueBytes returns the value of the key Next stopped at. The slice belongs
+// to the caller.
+func (it *Iterator) ValueBytes() []byte {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator. It is safe to call more than once.
+func (it *Iterator) Close() error {
+	it.done = true
+	it.stop()
+	it.snap.release()
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package engine
+
+// syncDir is a no-op on platforms where directories cannot be fsynced.
+func syncDir(directory string) error {
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package engine
+
+import (
+	"fmt"
+	"os"
+)
+
+// syncDir fsyncs a directory so that files created, renamed or removed in it
+// survive a power failure.
+func syncDir(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return fmt.Errorf("unable to open directory '%s': %w", directory, err)
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to sync directory '%s': %w", directory, err)
+	}
+	return nil
+}
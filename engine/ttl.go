@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// PutWithTTL stores value under key like Put, but the key expires once ttl
+// has passed. From then on it reads as not found, it is not restored when
+// the index is rebuilt and Merge drops it from disk. The sweeper configured
+// by Options.ExpirySweepInterval removes it from the keydir. An expiry
+// beyond the year 2262, the last one Unix nanoseconds can hold, is capped
+// there.
+func (be *BitcaskEngine) PutWithTTL(key, value string, ttl time.Duration) error {
+	if err := be.checkWritable(); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("invalid TTL %v: must be positive", ttl)
+	}
+
+	now := time.Now().UnixNano()
+	expiry := int64(math.MaxInt64)
+	if ttl < time.Duration(math.MaxInt64-now) {
+		expiry = now + int64(ttl)
+	}
+	record, err := encodeExpiringRecord(key, value, expiry, false)
+	if err != nil {
+		be.logger.Debug("Unable to encode record", be.keyAttr(key), "error", err)
+		return fmt.Errorf("failed to create file entry: %w", err)
+	}
+	return be.put(record)
+}
+
+// sweepLoop removes expired keys from the keydir every interval until Close.
+func (be *BitcaskEngine) sweepLoop(interval time.Duration) {
+	defer be.backgroundDone.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-be.stopBackground:
+			return
+		case <-ticker.C:
+			be.sweepExpired()
+		}
+	}
+}
+
+// sweepExpired removes every expired key from the keydir. It only holds the
+// exclusive lock to delete the keys found while scanning under the read lock.
+// Nothing is written to disk: expired records are skipped on rebuild anyway.
+func (be *BitcaskEngine) sweepExpired() {
+	type expiredKey struct {
+		key    string
+		record KeyDir
+	}
+
+	be.mu.RLock()
+	if be.closed || !be.hasExpiring {
+		be.mu.RUnlock()
+		return
+	}
+	now := time.Now().UnixNano()
+	var expired []expiredKey
+	be.keydir.Range("", "", false, func(key string, record KeyDir) bool {
+		if record.expiredAt(now) {
+			expired = append(expired, expiredKey{key: key, record: record})
+		}
+		return true
+	})
+	be.mu.RUnlock()
+
+	if len(expired) == 0 {
+		return
+	}
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	for _, e := range expired {
+		// Leave keys alone that were written again in the meantime.
+		if current, ok := be.keydir.Get(e.key); ok && current == e.record {
+			be.deleteKey(e.key)
+		}
+	}
+	be.logger.Debug("Swept expired keys", "keys", len(expired))
+}
+
+// skipExpired wraps a Range callback so it never sees keys that have expired
+// by the time skipExpired is called.
+func skipExpired(fn func(key string, record KeyDir) bool) func(string, KeyDir) bool {
+	now := time.Now().UnixNano()
+	return func(key string, record KeyDir) bool {
+		if record.expiredAt(now) {
+			return true
+		}
+		return fn(key, record)
+	}
+}
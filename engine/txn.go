@@ -0,0 +1,181 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+)
+
+// Txn is an optimistic transaction. It reads from a snapshot of the store
+// taken by Begin, sees its own writes, and buffers them until Commit, which
+// applies all of them atomically or none of them. A Txn is not safe for
+// concurrent use.
+type Txn struct {
+	be   *BitcaskEngine
+	snap *snapshot
+
+	// records holds the last write of every key, in the order the keys were
+	// first written; writes maps a key to its index in records.
+	records []*encodedRecord
+	writes  map[string]int
+	done    bool
+}
+
+// Begin starts a transaction reading from the store as it is now. Every
+// transaction must end with Commit or Rollback, since an open one keeps the
+// files replaced by Merge on disk.
+func (be *BitcaskEngine) Begin() (*Txn, error) {
+	snap, err := be.newSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Txn{be: be, snap: snap, writes: make(map[string]int)}, nil
+}
+
+// Get returns the value of key as written by the transaction or, if it has
+// not written key, as of Begin.
+func (tx *Txn) Get(key string) (string, error) {
+	value, err := tx.get(key)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// GetBytes is Get for binary keys and values. The returned slice belongs to
+// the caller.
+func (tx *Txn) GetBytes(key []byte) ([]byte, error) {
+	return tx.get(string(key))
+}
+
+func (tx *Txn) get(key string) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxnDone
+	}
+	if i, ok := tx.writes[key]; ok {
+		record := tx.records[i]
+		if record.isTombstone {
+			return nil, ErrKeyNotFound
+		}
+		return append([]byte(nil), record.buf[recordHeaderSize+len(record.key):]...), nil
+	}
+	return tx.snap.get(key)
+}
+
+// Put buffers a put of key until Commit.
+func (tx *Txn) Put(key, value string) error {
+	record, err := encodeRecord(key, value, false)
+	if err != nil {
+		return fmt.Errorf("failed to create file entry: %w", err)
+	}
+	return tx.write(record)
+}
+
+// PutBytes is Put for binary keys and values. The transaction keeps no
+// reference to value once PutBytes returns.
+func (tx *Txn) PutBytes(key, value []byte) error {
+	record, err := encodeRecord(key, value, false)
+	if err != nil {
+		return fmt.Errorf("failed to create file entry: %w", err)
+	}
+	return tx.write(record)
+}
+
+// Delete buffers a delete of key until Commit. It returns ErrKeyNotFound if
+// key does not exist as seen by the transaction.
+func (tx *Txn) Delete(key string) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	if i, ok := tx.writes[key]; ok {
+		if tx.records[i].isTombstone {
+			return ErrKeyNotFound
+		}
+	} else if record, ok := tx.snap.keydir.Get(key); !ok || record.expiredAt(time.Now().UnixNano()) {
+		return ErrKeyNotFound
+	}
+
+	record, err := encodeRecord(key, "", true)
+	if err != nil {
+		return fmt.Errorf("failed to create tombstone entry: %w", err)
+	}
+	return tx.write(record)
+}
+
+func (tx *Txn) write(record *encodedRecord) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	if i, ok := tx.writes[record.key]; ok {
+		tx.records[i] = record
+		return nil
+	}
+	tx.writes[record.key] = len(tx.records)
+	tx.records = append(tx.records, record)
+	return nil
+}
+
+// Commit writes the buffered writes as one batch and ends the transaction.
+// It fails with ErrConflict, writing nothing, if any key the transaction
+// writes was changed by someone else since Begin. A transaction that wrote
+// nothing commits without touching the store.
+func (tx *Txn) Commit() error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	defer tx.Rollback()
+
+	be := tx.be
+	if err := be.checkWritable(); err != nil {
+		return err
+	}
+	if len(tx.records) == 0 {
+		return nil
+	}
+
+	err := be.commit(&writeRequest{
+		records: tx.records,
+		batch:   true,
+		check:   tx.checkConflicts,
+	})
+	if err == ErrClosed || err == ErrConflict {
+		return err
+	}
+	if err != nil {
+		be.logger.Error("Unable to write transaction", "records", len(tx.records), "error", err)
+		return fmt.Errorf("unable to write transaction: %w", err)
+	}
+	return nil
+}
+
+// checkConflicts runs under be.mu and fails if a key the transaction writes
+// was written since its snapshot was taken. Every record has a unique
+// sequence number, so comparing them catches any write, while a Merge that
+// merely relocated the key keeps its sequence number and does not conflict.
+// A key that had expired when the snapshot was taken counts as absent, and so
+// does one that has expired since, whether or not it has been swept yet.
+func (tx *Txn) checkConflicts() error {
+	now := time.Now().UnixNano()
+	for _, record := range tx.records {
+		current, exists := tx.be.keydir.Get(record.key)
+		exists = exists && !current.expiredAt(now)
+		original, existed := tx.snap.keydir.Get(record.key)
+		existed = existed && !original.expiredAt(tx.snap.takenAt)
+		if exists != existed || (exists && current.Tstamp != original.Tstamp) {
+			tx.be.logger.Debug("Transaction conflict", tx.be.keyAttr(record.key))
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// Rollback discards the buffered writes and ends the transaction. Calling it
+// after Commit or Rollback does nothing, so it can be deferred.
+func (tx *Txn) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.records = nil
+	tx.writes = nil
+	tx.snap.release()
+}